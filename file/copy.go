@@ -0,0 +1,135 @@
+package file
+
+import (
+	"hash/crc32"
+	"io/fs"
+	"iter"
+	"sync"
+	"time"
+)
+
+// Loaded is an entry with its data and checksum read in advance, possibly
+// under a new path. Trees take the data from it as is.
+type Loaded struct {
+	Entry
+	Path string
+	Data []byte
+	CRC  uint32
+}
+
+func Load(e Entry) (*Loaded, error) {
+	if l, ok := e.(*Loaded); ok {
+		return l, nil
+	}
+	data, err := e.GetData()
+	if err != nil {
+		return nil, err
+	}
+	return &Loaded{e, e.GetPath(), data, crc32.ChecksumIEEE(data)}, nil
+}
+
+func (l *Loaded) String() string {
+	return l.Path
+}
+
+func (l *Loaded) GetPath() string {
+	return l.Path
+}
+
+func (l *Loaded) GetData() ([]byte, error) {
+	return l.Data, nil
+}
+
+func (l *Loaded) GetSize() (int64, error) {
+	return int64(len(l.Data)), nil
+}
+
+func (l *Loaded) GetModTime() (time.Time, error) {
+	return ModTime(l.Entry)
+}
+
+func (l *Loaded) GetMode() (fs.FileMode, error) {
+	return Mode(l.Entry)
+}
+
+func (l *Loaded) GetHash() (uint32, error) {
+	return l.CRC, nil
+}
+
+// Copy puts the entries, given as destination path and source entry, into
+// dst. The data is read and checksummed by up to jobs workers while the
+// entries are put one by one in the original order, so the result doesn't
+// depend on the number of workers. The listener is called after each put.
+// Every destination path is checked against the rules of dst before anything
+// is copied.
+func Copy(dst Tree, entries iter.Seq2[string, Entry], jobs int, ln func(path string)) error {
+	type job struct {
+		path string
+		e    Entry
+		l    *Loaded
+		err  error
+		done chan struct{}
+	}
+	var list []*job
+	for p, e := range entries {
+		p, err := ValidPath(dst, p)
+		if err != nil {
+			return err
+		}
+		list = append(list, &job{path: p, e: e, done: make(chan struct{})})
+	}
+	jobs = max(1, min(jobs, len(list)))
+
+	queue := make(chan *job)
+	window := make(chan struct{}, 4*jobs) // bounds the data loaded ahead
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if j.l, j.err = Load(j.e); j.err == nil && j.l.Path != j.path {
+					c := *j.l
+					c.Path = j.path
+					j.l = &c
+				}
+				close(j.done)
+			}
+		}()
+	}
+	go func() {
+		defer close(queue)
+		for _, j := range list {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			select {
+			case queue <- j:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var err error
+	for _, j := range list {
+		<-j.done
+		if err = j.err; err != nil {
+			break
+		}
+		if _, err = dst.Put(j.l); err != nil {
+			break
+		}
+		j.l = nil
+		<-window
+		if ln != nil {
+			ln(j.path)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	return err
+}
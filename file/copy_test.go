@@ -0,0 +1,86 @@
+package file_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"packman/file"
+	"packman/file/mem"
+	"packman/file/vpk"
+	"sync"
+	"testing"
+)
+
+func TestCopyOrder(t *testing.T) {
+	src, err := file.LocalTree("test/local")
+	require.NoError(t, err)
+
+	pack := func(jobs int) []byte {
+		var dst vpk.Tree
+		var copied []string
+		require.NoError(t, file.Copy(&dst, src.Find(""), jobs, func(path string) {
+			copied = append(copied, path)
+		}))
+		var exp []string
+		for p := range src.Find("") {
+			exp = append(exp, p)
+		}
+		require.Equal(t, exp, copied)
+		data, err := dst.Pack()
+		require.NoError(t, err)
+		return data
+	}
+	exp := pack(1)
+	for _, jobs := range []int{0, 2, 8} {
+		require.Equal(t, exp, pack(jobs), jobs)
+	}
+}
+
+type failing string
+
+func (f failing) String() string           { return string(f) }
+func (f failing) GetPath() string          { return string(f) }
+func (f failing) GetData() ([]byte, error) { return nil, errors.New("read failed") }
+func (f failing) GetSize() (int64, error)  { return 0, nil }
+
+func TestCopyError(t *testing.T) {
+	src, err := file.LocalTree("test/local")
+	require.NoError(t, err)
+
+	var dst vpk.Tree
+	entries := func(yield func(string, file.Entry) bool) {
+		if !yield("a.txt", failing("a.txt")) {
+			return
+		}
+		for p, e := range src.Find("") {
+			if !yield(p, e) {
+				return
+			}
+		}
+	}
+	require.EqualError(t, file.Copy(&dst, entries, 4, nil), "read failed")
+	require.Equal(t, 0, len(dst))
+}
+
+func TestSynchronized(t *testing.T) {
+	s := make(mem.Store)
+	tree := file.Synchronized(&s)
+	require.Same(t, tree, file.Synchronized(tree))
+	require.Same(t, &s, file.Unwrap(file.ReadOnly(tree)))
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				_, err := tree.Store(fmt.Sprintf("dir%d/file%d", i, j), []byte{byte(j)})
+				require.NoError(t, err)
+				for range tree.Find(fmt.Sprintf("dir%d", i)) {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 800, len(s))
+}
@@ -0,0 +1,121 @@
+package file
+
+import (
+	"bytes"
+	"iter"
+	"maps"
+	"slices"
+)
+
+type Change int
+
+const (
+	Added Change = iota + 1
+	Removed
+	Modified
+)
+
+func (c Change) String() string {
+	switch c {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	default:
+		return "unchanged"
+	}
+}
+
+func (c Change) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+type Delta struct {
+	Path   string `json:"path"`
+	Change Change `json:"change"`
+}
+
+// Diff lists the files that differ between a and b ordered by path. A file
+// only in b is Added and a file only in a is Removed.
+func Diff(a, b Tree) ([]Delta, error) {
+	return diff(a.Find(""), b.Find(""))
+}
+
+// DiffDir is Diff of the directories aDir of a and bDir of b, or of two
+// files listed as ".".
+func DiffDir(a Tree, aDir string, b Tree, bDir string) ([]Delta, error) {
+	return diff(a.Find(aDir), b.Find(bDir))
+}
+
+func diff(a, b iter.Seq2[string, Entry]) ([]Delta, error) {
+	old, cur := maps.Collect(a), maps.Collect(b)
+	paths := slices.Sorted(maps.Keys(old))
+	for p := range cur {
+		if _, ok := old[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	slices.Sort(paths)
+
+	var list []Delta
+	for _, p := range paths {
+		x, inA := old[p]
+		y, inB := cur[p]
+		switch {
+		case !inA:
+			list = append(list, Delta{p, Added})
+		case !inB:
+			list = append(list, Delta{p, Removed})
+		default:
+			same, err := Same(x, y)
+			if err != nil {
+				return nil, err
+			}
+			if !same {
+				list = append(list, Delta{p, Modified})
+			}
+		}
+	}
+	return list, nil
+}
+
+// Same reports whether two entries hold the same data. Sizes are compared
+// first, then hashes when both entries provide them without reading, and the
+// data itself otherwise.
+func Same(a, b Entry) (bool, error) {
+	sa, err := a.GetSize()
+	if err != nil {
+		return false, err
+	}
+	sb, err := b.GetSize()
+	if err != nil {
+		return false, err
+	}
+	if sa != sb {
+		return false, nil
+	}
+	ma, okA := a.(Meta)
+	mb, okB := b.(Meta)
+	if okA && okB {
+		ha, err := ma.GetHash()
+		if err != nil {
+			return false, err
+		}
+		hb, err := mb.GetHash()
+		if err != nil {
+			return false, err
+		}
+		return ha == hb, nil
+	}
+	da, err := a.GetData()
+	if err != nil {
+		return false, err
+	}
+	db, err := b.GetData()
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(da, db), nil
+}
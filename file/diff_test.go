@@ -0,0 +1,51 @@
+package file_test
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"packman/file"
+	"packman/file/mem"
+	"packman/file/vpk"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	a := make(mem.Store)
+	for p, data := range map[string]string{"same": "1", "gone": "2", "size": "3", "data": "4"} {
+		_, err := a.Store(p, []byte(data))
+		require.NoError(t, err)
+	}
+	var b vpk.Tree
+	for p, data := range map[string]string{"same": "1", "new": "5", "size": "33", "data": "5"} {
+		_, err := b.Store(p, []byte(data))
+		require.NoError(t, err)
+	}
+
+	list, err := file.Diff(&a, &b)
+	require.NoError(t, err)
+	require.Equal(t, []file.Delta{
+		{"data", file.Modified},
+		{"gone", file.Removed},
+		{"new", file.Added},
+		{"size", file.Modified},
+	}, list)
+
+	list, err = file.Diff(&b, &b)
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	data, err := json.Marshal(file.Delta{"x", file.Added})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"path":"x","change":"added"}`, string(data))
+}
+
+func TestDiffLocal(t *testing.T) {
+	src, err := file.LocalTree("test/local")
+	require.NoError(t, err)
+	var dst vpk.Tree
+	require.NoError(t, file.Copy(&dst, src.Find(""), 1, nil))
+
+	list, err := file.Diff(src, &dst)
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
@@ -0,0 +1,284 @@
+// Package filetest checks file.Tree implementations against the contract
+// documented on file.Tree.
+package filetest
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"maps"
+	"os"
+	"packman/file"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Factory returns a new tree holding exactly the given files (path -> data).
+type Factory func(t *testing.T, files map[string]string) file.Tree
+
+var fixture = map[string]string{
+	"file01.txt":            "file01",
+	"dir1/file11.txt":       "file11",
+	"dir1/dir11/file111.md": "file111",
+	"dir2/file22.txt":       "file22",
+}
+
+// TestTree runs the conformance suite. Write operations are checked only if
+// the tree isn't read-only, otherwise they must all fail with file.ErrReadOnly.
+// Writes must also reject the paths file.DefaultRules reject.
+func TestTree(t *testing.T, newTree Factory) {
+	t.Run("Get", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		for _, p := range []string{"dir1/file11.txt", "/dir1/file11.txt", "dir1/file11.txt/"} {
+			e, err := tree.Get(p)
+			require.NoError(t, err, p)
+			assert.Equal(t, "dir1/file11.txt", e.GetPath(), p)
+			assert.Equal(t, "file11", data(t, e))
+			sz, err := e.GetSize()
+			require.NoError(t, err)
+			assert.Equal(t, int64(6), sz)
+		}
+		e, err := tree.Get("file01.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "file01.txt", e.GetPath())
+		for _, p := range []string{"", ".", "/", "dir1", "dir1/dir11/"} {
+			_, err := tree.Get(p)
+			assert.ErrorIs(t, err, os.ErrInvalid, p)
+		}
+		for _, p := range []string{"dir", "dir3/file.txt", "dir1/file11"} {
+			_, err := tree.Get(p)
+			assert.ErrorIs(t, err, os.ErrNotExist, p)
+		}
+	})
+
+	t.Run("Find", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		all := "dir1/dir11/file111.md dir1/file11.txt dir2/file22.txt file01.txt"
+		for _, p := range []string{"", ".", "/"} {
+			assert.Equal(t, all, find(tree, p), p)
+		}
+		for _, p := range []string{"dir1", "dir1/", "/dir1"} {
+			assert.Equal(t, "dir11/file111.md file11.txt", find(tree, p), p)
+		}
+		for _, p := range []string{"dir1/file11.txt", "file01.txt", "dir1/dir11/file111.md"} {
+			files := maps.Collect(tree.Find(p))
+			require.Equal(t, 1, len(files), p)
+			require.Contains(t, files, ".", p)
+			assert.Equal(t, file.Clean(p), files["."].GetPath())
+		}
+		assert.Equal(t, "", find(tree, "dir"))
+		assert.Equal(t, "", find(tree, "dir3"))
+		for range tree.Find("") {
+			break
+		}
+		for p := range tree.Find("") {
+			_, err := tree.Get(p)
+			require.NoError(t, err, p)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		for p, k := range map[string]file.Kind{
+			"":                file.Directory,
+			".":               file.Directory,
+			"dir1":            file.Directory,
+			"dir1/dir11/":     file.Directory,
+			"file01.txt":      file.Regular,
+			"dir1/file11.txt": file.Regular,
+			"dir":             file.Absent,
+			"dir3/file.txt":   file.Absent,
+		} {
+			kind, err := tree.Stat(p)
+			require.NoError(t, err, p)
+			assert.Equal(t, k, kind, p)
+		}
+	})
+
+	t.Run("ReadDir", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		assert.Equal(t, "dir1/ dir2/ file01.txt", readDir(t, tree, ""))
+		assert.Equal(t, "dir1/ dir2/ file01.txt", readDir(t, tree, "/"))
+		assert.Equal(t, "dir11/ file11.txt", readDir(t, tree, "dir1"))
+		_, err := tree.ReadDir("dir1/file11.txt")
+		assert.ErrorIs(t, err, os.ErrInvalid)
+		_, err = tree.ReadDir("dir3")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	if _, err := newTree(t, nil).Store("probe.txt", nil); errors.Is(err, file.ErrReadOnly) {
+		t.Run("ReadOnly", func(t *testing.T) {
+			tree := newTree(t, fixture)
+			_, err := tree.Put(stub{"file03.txt", "file03"})
+			assert.ErrorIs(t, err, file.ErrReadOnly)
+			assert.ErrorIs(t, tree.Remove("file01.txt", nil), file.ErrReadOnly)
+			assert.ErrorIs(t, tree.Rename("file01.txt", "file03.txt"), file.ErrReadOnly)
+		})
+		return
+	}
+
+	t.Run("Store", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		e, err := tree.Store("/dir3/file33.txt", []byte("file33"))
+		require.NoError(t, err)
+		assert.Equal(t, "dir3/file33.txt", e.GetPath())
+		assert.Equal(t, "file33", read(t, tree, "dir3/file33.txt"))
+
+		_, err = tree.Store("dir1/file11.txt", []byte("file11+"))
+		require.NoError(t, err)
+		assert.Equal(t, "file11+", read(t, tree, "dir1/file11.txt"))
+
+		_, err = tree.Store("file03", []byte("file03"))
+		require.NoError(t, err)
+		assert.Equal(t, "file03", read(t, tree, "file03"))
+
+		for _, p := range []string{"", ".", "/"} {
+			_, err := tree.Store(p, nil)
+			assert.ErrorIs(t, err, os.ErrInvalid, p)
+		}
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		e, err := tree.Put(stub{"dir3/file33.txt", "file33"})
+		require.NoError(t, err)
+		assert.Equal(t, "dir3/file33.txt", e.GetPath())
+		assert.Equal(t, "file33", read(t, tree, "dir3/file33.txt"))
+
+		src, err := tree.Get("dir2/file22.txt")
+		require.NoError(t, err)
+		_, err = newTree(t, nil).Put(src)
+		require.NoError(t, err)
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		var removed []string
+		ln := func(path string) {
+			removed = append(removed, path)
+		}
+
+		require.NoError(t, tree.Remove("file01.txt", ln))
+		assert.Equal(t, "dir1/dir11/file111.md dir1/file11.txt dir2/file22.txt", find(tree, ""))
+		assert.Equal(t, []string{"file01.txt"}, removed)
+
+		removed = nil
+		require.NoError(t, tree.Remove("dir1/", ln))
+		assert.Equal(t, "dir2/file22.txt", find(tree, ""))
+		slices.Sort(removed)
+		assert.Equal(t, []string{"dir1/dir11/file111.md", "dir1/file11.txt"}, removed)
+		kind, err := tree.Stat("dir1")
+		require.NoError(t, err)
+		assert.Equal(t, file.Absent, kind)
+
+		require.NoError(t, tree.Remove("dir3", nil))
+		require.NoError(t, tree.Remove("dir", nil))
+		assert.Equal(t, "dir2/file22.txt", find(tree, ""))
+
+		require.NoError(t, tree.Remove("", nil))
+		assert.Equal(t, "", find(tree, ""))
+		kind, err = tree.Stat("")
+		require.NoError(t, err)
+		assert.Equal(t, file.Directory, kind)
+	})
+
+	t.Run("Rename", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		require.NoError(t, tree.Rename("file01.txt", "dir3/file03.md"))
+		assert.Equal(t, "file01", read(t, tree, "dir3/file03.md"))
+		_, err := tree.Get("file01.txt")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+
+		require.NoError(t, tree.Rename("dir1", "dir2/dir1"))
+		assert.Equal(t, "dir1/dir11/file111.md dir1/file11.txt file22.txt", find(tree, "dir2"))
+		assert.Equal(t, "dir2/dir1/file11.txt", get(t, tree, "dir2/dir1/file11.txt").GetPath())
+
+		assert.ErrorIs(t, tree.Rename("dir1", "dir4"), os.ErrNotExist)
+		assert.ErrorIs(t, tree.Rename("", "dir4"), os.ErrInvalid)
+		assert.ErrorIs(t, tree.Rename("dir2", ""), os.ErrInvalid)
+
+		tree = newTree(t, fixture)
+		require.NoError(t, tree.Rename("file01.txt", "dir2/file22.txt"))
+		assert.Equal(t, "file01", read(t, tree, "dir2/file22.txt"))
+		assert.ErrorIs(t, tree.Rename("dir1/file11.txt", "dir2"), os.ErrExist)
+		assert.ErrorIs(t, tree.Rename("dir1", "dir2"), os.ErrExist)
+		assert.ErrorIs(t, tree.Rename("dir1", "dir2/file22.txt"), os.ErrExist)
+		assert.ErrorIs(t, tree.Rename("dir1/file11.txt", "dir2/file22.txt/file11.txt"), os.ErrExist)
+		assert.ErrorIs(t, tree.Rename("dir1", "dir1/dir11/dir1"), os.ErrInvalid)
+		assert.Equal(t, "dir1/dir11/file111.md dir1/file11.txt dir2/file22.txt", find(tree, ""))
+	})
+
+	t.Run("InvalidPath", func(t *testing.T) {
+		tree := newTree(t, fixture)
+		for _, p := range []string{"dir3/a\x00b", "../file03", "dir1/../../file03", "\xff"} {
+			_, err := tree.Store(p, nil)
+			assert.ErrorIs(t, err, os.ErrInvalid, p)
+			_, err = tree.Put(stub{p, ""})
+			assert.ErrorIs(t, err, os.ErrInvalid, p)
+			assert.ErrorIs(t, tree.Rename("file01.txt", p), os.ErrInvalid, p)
+		}
+		assert.Equal(t, "dir1/dir11/file111.md dir1/file11.txt dir2/file22.txt file01.txt", find(tree, ""))
+
+		_, err := tree.Store("dir3/e\u0301.txt", []byte("e"))
+		require.NoError(t, err)
+		assert.Equal(t, "e", read(t, tree, "dir3/\u00e9.txt"))
+		assert.Equal(t, "e", read(t, tree, "dir3/e\u0301.txt"))
+		assert.Equal(t, "dir3/\u00e9.txt", get(t, tree, "dir3/e\u0301.txt").GetPath())
+	})
+}
+
+type stub struct {
+	path string
+	data string
+}
+
+func (s stub) String() string {
+	return s.path
+}
+
+func (s stub) GetPath() string {
+	return s.path
+}
+
+func (s stub) GetData() ([]byte, error) {
+	return []byte(s.data), nil
+}
+
+func (s stub) GetSize() (int64, error) {
+	return int64(len(s.data)), nil
+}
+
+func find(tree file.Tree, path string) string {
+	files := slices.Collect(maps.Keys(maps.Collect(tree.Find(path))))
+	slices.Sort(files)
+	return strings.Join(files, " ")
+}
+
+func get(t *testing.T, tree file.Tree, path string) file.Entry {
+	e, err := tree.Get(path)
+	require.NoError(t, err, path)
+	return e
+}
+
+func read(t *testing.T, tree file.Tree, path string) string {
+	return data(t, get(t, tree, path))
+}
+
+func data(t *testing.T, e file.Entry) string {
+	d, err := e.GetData()
+	require.NoError(t, err, e.GetPath())
+	return string(d)
+}
+
+func readDir(t *testing.T, tree file.Tree, path string) string {
+	list, err := tree.ReadDir(path)
+	require.NoError(t, err, path)
+	names := make([]string, len(list))
+	for i, e := range list {
+		if names[i] = e.Name; e.Kind == file.Directory {
+			names[i] += "/"
+		}
+	}
+	return strings.Join(names, " ")
+}
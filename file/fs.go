@@ -0,0 +1,167 @@
+package file
+
+import (
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"iter"
+	"os"
+	"time"
+)
+
+var ErrReadOnly = errors.New("read-only tree")
+
+type fsEntry struct {
+	fsys fs.FS
+	path string
+}
+
+func (e fsEntry) String() string {
+	return e.path
+}
+
+func (e fsEntry) GetPath() string {
+	return e.path
+}
+
+func (e fsEntry) GetData() ([]byte, error) {
+	return fs.ReadFile(e.fsys, e.path)
+}
+
+func (e fsEntry) GetSize() (int64, error) {
+	s, err := fs.Stat(e.fsys, e.path)
+	if err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
+}
+
+func (e fsEntry) GetModTime() (time.Time, error) {
+	s, err := fs.Stat(e.fsys, e.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.ModTime(), nil
+}
+
+func (e fsEntry) GetMode() (fs.FileMode, error) {
+	s, err := fs.Stat(e.fsys, e.path)
+	if err != nil {
+		return 0, err
+	}
+	return s.Mode(), nil
+}
+
+func (e fsEntry) GetHash() (uint32, error) {
+	data, err := e.GetData()
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+type fsTree struct {
+	fsys fs.FS
+}
+
+func fsPath(path string) string {
+	if path = Norm(path); path == "" {
+		return "."
+	}
+	return path
+}
+
+func (t fsTree) Pack() ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (t fsTree) Get(path string) (Entry, error) {
+	path = fsPath(path)
+	s, err := fs.Stat(t.fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	return fsEntry{t.fsys, path}, nil
+}
+
+func (t fsTree) Find(path string) iter.Seq2[string, Entry] {
+	return func(yield func(string, Entry) bool) {
+		path := fsPath(path)
+		_ = fs.WalkDir(t.fsys, path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel := "."
+			if p != path {
+				rel, _ = Base(p, path)
+				if path == "." {
+					rel = p
+				}
+			}
+			if !yield(rel, fsEntry{t.fsys, p}) {
+				return fs.SkipAll
+			}
+			return nil
+		})
+	}
+}
+
+func (t fsTree) Stat(path string) (Kind, error) {
+	s, err := fs.Stat(t.fsys, fsPath(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return Absent, nil
+		}
+		return Absent, err
+	}
+	if s.IsDir() {
+		return Directory, nil
+	}
+	return Regular, nil
+}
+
+func (t fsTree) ReadDir(path string) ([]DirEntry, error) {
+	path = fsPath(path)
+	s, err := fs.Stat(t.fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	dir, err := fs.ReadDir(t.fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]DirEntry, len(dir))
+	for i, e := range dir {
+		list[i] = DirEntry{e.Name(), Regular}
+		if e.IsDir() {
+			list[i].Kind = Directory
+		}
+	}
+	return list, nil
+}
+
+func (t fsTree) Remove(string, func(path string)) error {
+	return ErrReadOnly
+}
+
+func (t fsTree) Rename(string, string) error {
+	return ErrReadOnly
+}
+
+func (t fsTree) Store(string, []byte) (Entry, error) {
+	return nil, ErrReadOnly
+}
+
+func (t fsTree) Put(Entry) (Entry, error) {
+	return nil, ErrReadOnly
+}
+
+func FSTree(fsys fs.FS) Tree {
+	return fsTree{fsys}
+}
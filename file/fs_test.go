@@ -0,0 +1,55 @@
+package file
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFSFindAll(t *testing.T) {
+	tree := FSTree(os.DirFS("test/local"))
+
+	files := slices.Collect(maps.Keys(maps.Collect(tree.Find(""))))
+	slices.Sort(files)
+	require.Equal(t, string(listAll), strings.Join(files, "\n"))
+
+	dir1 := slices.Collect(maps.Keys(maps.Collect(tree.Find("dir1/"))))
+	slices.Sort(dir1)
+	require.Equal(t, string(listDir1), strings.Join(dir1, "\n"))
+}
+
+func TestFSGet(t *testing.T) {
+	tree := FSTree(fstest.MapFS{
+		"a/b.txt": {Data: []byte("b")},
+	})
+
+	e, err := tree.Get("/a/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "a/b.txt", e.GetPath())
+	data, err := e.GetData()
+	require.NoError(t, err)
+	require.Equal(t, "b", string(data))
+
+	files := maps.Collect(tree.Find("a/b.txt"))
+	require.Equal(t, 1, len(files))
+	require.Contains(t, files, ".")
+
+	_, err = tree.Get("a")
+	require.True(t, errors.Is(err, os.ErrInvalid))
+
+	_, err = tree.Get("c")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestFSReadOnly(t *testing.T) {
+	tree := FSTree(fstest.MapFS{})
+
+	_, err := tree.Store("a.txt", nil)
+	require.True(t, errors.Is(err, ErrReadOnly))
+	require.True(t, errors.Is(tree.Remove("a.txt", nil), ErrReadOnly))
+}
@@ -0,0 +1,175 @@
+package file
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"iter"
+	"path"
+	"slices"
+	"strings"
+)
+
+func HasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[{\`)
+}
+
+// Match reports whether name matches the shell pattern. Besides the path.Match
+// syntax it supports ** matching any number of directories and {a,b}
+// alternatives, which may be nested.
+func Match(pattern, name string) (bool, error) {
+	names := strings.Split(name, "/")
+	for _, p := range expandBraces(pattern) {
+		ok, err := matchSegs(strings.Split(p, "/"), names)
+		if ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func ValidPattern(pattern string) error {
+	for _, p := range expandBraces(pattern) {
+		for _, seg := range strings.Split(p, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func matchSegs(pats, names []string) (bool, error) {
+	for len(pats) != 0 {
+		if pats[0] == "**" {
+			for len(pats) != 0 && pats[0] == "**" {
+				pats = pats[1:]
+			}
+			if len(pats) == 0 {
+				return true, nil
+			}
+			for i := range names {
+				if ok, err := matchSegs(pats, names[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pats[0], names[0]); !ok || err != nil {
+			return false, err
+		}
+		pats, names = pats[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
+
+func expandBraces(pattern string) []string {
+	start, depth, class := -1, 0, false
+	var alts []string
+	last := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case class:
+			class = c != ']'
+		case c == '[':
+			class = true
+		case c == '{':
+			if depth++; depth == 1 {
+				start, last = i, i+1
+			}
+		case c == ',' && depth == 1:
+			alts = append(alts, pattern[last:i])
+			last = i + 1
+		case c == '}' && depth > 0:
+			if depth--; depth != 0 {
+				continue
+			}
+			alts = append(alts, pattern[last:i])
+			var list []string
+			for _, suffix := range expandBraces(pattern[i+1:]) {
+				for _, alt := range alts {
+					for _, a := range expandBraces(alt) {
+						list = append(list, pattern[:start]+a+suffix)
+					}
+				}
+			}
+			return list
+		}
+	}
+	return []string{pattern}
+}
+
+// Glob yields the files matching the pattern with paths relative to its
+// longest literal directory prefix, so Glob(t, "a/*/b.txt") yields "x/b.txt"
+// for "a/x/b.txt". A pattern without meta characters works like Find.
+func Glob(t Tree, pattern string) iter.Seq2[string, Entry] {
+	if !HasMeta(pattern) {
+		return t.Find(Key(pattern))
+	}
+	pattern = patternKey(pattern)
+	base, rest := splitGlob(pattern)
+	return func(yield func(string, Entry) bool) {
+		for p, e := range t.Find(base) {
+			if ok, _ := Match(rest, p); ok && !yield(p, e) {
+				return
+			}
+		}
+	}
+}
+
+// patternKey normalizes a pattern like Key except for backslashes, which
+// escape meta characters in patterns.
+func patternKey(pattern string) string {
+	if pattern = strings.Trim(path.Clean(norm.NFC.String(pattern)), "/"); pattern == "." {
+		return ""
+	}
+	return pattern
+}
+
+func splitGlob(pattern string) (base, rest string) {
+	segs := strings.Split(pattern, "/")
+	n := 0
+	for n < len(segs) && !HasMeta(segs[n]) {
+		n++
+	}
+	return strings.Join(segs[:n], "/"), strings.Join(segs[n:], "/")
+}
+
+// GlobPaths returns the files and directories matching the pattern in lexical
+// order, relative to its literal prefix like Glob. A pattern without meta
+// characters matches itself if it exists and yields "".
+func GlobPaths(t Tree, pattern string) ([]string, error) {
+	if !HasMeta(pattern) {
+		kind, err := t.Stat(Key(pattern))
+		if err != nil || kind == Absent {
+			return nil, err
+		}
+		return []string{""}, nil
+	}
+	pattern = patternKey(pattern)
+	base, rest := splitGlob(pattern)
+	found := make(map[string]bool)
+	for p := range t.Find(base) {
+		for ; p != "" && p != "."; p, _ = Split(p) {
+			if _, seen := found[p]; seen {
+				break
+			}
+			ok, err := Match(rest, p)
+			if err != nil {
+				return nil, err
+			}
+			found[p] = ok
+		}
+	}
+	var list []string
+	for p, ok := range found {
+		if ok {
+			list = append(list, p)
+		}
+	}
+	slices.Sort(list)
+	return list, nil
+}
@@ -0,0 +1,75 @@
+package file
+
+import (
+	"github.com/stretchr/testify/require"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*.txt", "file01.txt", true},
+		{"*.txt", "dir1/file11.txt", false},
+		{"**/*.txt", "file01.txt", true},
+		{"**/*.txt", "dir1/dir12/file121.txt", true},
+		{"dir1/**", "dir1/dir11/file111.md", true},
+		{"dir1/**/file1?.txt", "dir1/file11.txt", true},
+		{"*.{txt,md}", "file02.md", true},
+		{"*.{txt,md}", "file02.vmt", false},
+		{"dir{1,2}/{file2*,dir1{1,2}/*}", "dir1/dir12/file121.txt", true},
+		{"dir{1,2}/{file2*,dir1{1,2}/*}", "dir2/file22.txt", true},
+		{"dir{1,2}/{file2*,dir1{1,2}/*}", "dir1/file11.txt", false},
+		{"[a-c]{x,y}", "bx", true},
+		{`\{a\}`, "{a}", true},
+	} {
+		ok, err := Match(c.pattern, c.name)
+		require.NoError(t, err)
+		require.Equal(t, c.match, ok, "%s %s", c.pattern, c.name)
+	}
+	require.Error(t, ValidPattern("dir/[a"))
+	require.NoError(t, ValidPattern("dir/**/*.{txt,md}"))
+}
+
+func TestGlob(t *testing.T) {
+	loc, err := LocalTree("test/local")
+	require.NoError(t, err)
+
+	glob := func(pattern string) string {
+		files := slices.Collect(maps.Keys(maps.Collect(Glob(loc, pattern))))
+		slices.Sort(files)
+		return strings.Join(files, " ")
+	}
+
+	require.Equal(t, "file01.txt file02.md", glob("*.{txt,md}"))
+	require.Equal(t, "dir1/dir11/file111.md file02.md", glob("**/*.md"))
+	require.Equal(t, "dir11/file111.md", glob("dir1/**/*.md"))
+	require.Equal(t, "dir1/file11.txt dir1/file12.txt dir2/file22.txt", glob("dir?/file*.txt"))
+	require.Equal(t, "dir11/file111.md dir12/file121.txt file11.txt file12.txt", glob("dir1"))
+}
+
+func TestGlobPaths(t *testing.T) {
+	loc, err := LocalTree("test/local")
+	require.NoError(t, err)
+
+	glob := func(pattern string) string {
+		list, err := GlobPaths(loc, pattern)
+		require.NoError(t, err)
+		return strings.Join(list, " ")
+	}
+
+	require.Equal(t, "dir1 dir2 file01.txt file02.md", glob("*"))
+	require.Equal(t, "dir11 dir12", glob("dir1/dir*"))
+	require.Equal(t, "dir1 dir1/dir11 dir1/dir12 dir2", glob("**/dir*"))
+	require.Equal(t, "", glob("none/*"))
+	list, err := GlobPaths(loc, "dir1")
+	require.NoError(t, err)
+	require.Equal(t, []string{""}, list)
+	list, err = GlobPaths(loc, "none")
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
@@ -3,13 +3,51 @@ package file
 import (
 	"errors"
 	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"hash/crc32"
 	"io/fs"
 	"iter"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"time"
 )
 
+var (
+	ErrSymlink     = errors.New("symbolic link")
+	ErrSymlinkLoop = errors.New("symbolic link loop")
+)
+
+type Symlinks int
+
+const (
+	FollowSymlinks Symlinks = iota
+	SkipSymlinks
+	RejectSymlinks
+)
+
+func (s Symlinks) String() string {
+	switch s {
+	case SkipSymlinks:
+		return "skip"
+	case RejectSymlinks:
+		return "error"
+	default:
+		return "follow"
+	}
+}
+
+func ParseSymlinks(s string) (Symlinks, bool) {
+	for _, l := range []Symlinks{FollowSymlinks, SkipSymlinks, RejectSymlinks} {
+		if l.String() == s {
+			return l, true
+		}
+	}
+	return FollowSymlinks, false
+}
+
 type entry struct {
 	local
 	path string
@@ -24,12 +62,12 @@ func (e entry) GetPath() string {
 }
 
 func (e entry) GetData() ([]byte, error) {
-	path := filepath.Join(string(e.local), e.path)
+	path := filepath.Join(e.root, e.path)
 	return os.ReadFile(path)
 }
 
 func (e entry) GetSize() (int64, error) {
-	path := filepath.Join(string(e.local), e.path)
+	path := filepath.Join(e.root, e.path)
 	s, err := os.Stat(path)
 	if err != nil {
 		return 0, err
@@ -37,71 +75,355 @@ func (e entry) GetSize() (int64, error) {
 	return s.Size(), nil
 }
 
-type local string
+func (e entry) GetModTime() (time.Time, error) {
+	s, err := os.Stat(filepath.Join(e.root, e.path))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return s.ModTime(), nil
+}
+
+func (e entry) GetMode() (fs.FileMode, error) {
+	s, err := os.Stat(filepath.Join(e.root, e.path))
+	if err != nil {
+		return 0, err
+	}
+	return s.Mode(), nil
+}
+
+func (e entry) GetHash() (uint32, error) {
+	data, err := e.GetData()
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+type broken struct {
+	path string
+	err  error
+}
+
+func (b broken) String() string {
+	return b.path
+}
+
+func (b broken) GetPath() string {
+	return b.path
+}
+
+func (b broken) GetData() ([]byte, error) {
+	return nil, b.err
+}
+
+func (b broken) GetSize() (int64, error) {
+	return 0, b.err
+}
+
+type local struct {
+	root  string
+	links Symlinks
+}
 
 func (l local) Pack() ([]byte, error) {
 	return nil, errors.ErrUnsupported
 }
 
 func (l local) Get(path string) (Entry, error) {
-	path, err := l.abs(path)
+	path, err := l.resolve(path, read)
 	if err != nil {
 		return nil, err
 	}
 	s, err := os.Stat(path)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
+	if err != nil {
 		return nil, err
 	}
 	if s.IsDir() {
 		return nil, os.ErrInvalid
 	}
-	return &entry{l, path[len(l)+1:]}, nil
+	return entry{l, l.rel(path)}, nil
 }
 
 func (l local) Find(path string) iter.Seq2[string, Entry] {
 	return func(yield func(string, Entry) bool) {
-		path, err := l.abs(path)
+		p, err := l.resolve(path, read)
+		if err != nil {
+			if errors.Is(err, ErrSymlink) {
+				yield(".", broken{Norm(path), err})
+			}
+			return
+		}
+		s, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+		if !s.IsDir() {
+			yield(".", entry{l, l.rel(p)})
+			return
+		}
+		real, err := filepath.EvalSymlinks(p)
 		if err != nil {
 			return
 		}
+		l.walk(p, "", []string{real}, yield)
+	}
+}
 
-		_ = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
-				return err
+// walk yields the files under dir. The seen list holds the resolved paths of
+// dir and its parents, a followed link leading to any of them is a loop.
+func (l local) walk(dir, rel string, seen []string, yield func(string, Entry) bool) bool {
+	list, err := os.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, d := range list {
+		p, r := filepath.Join(dir, d.Name()), d.Name()
+		if rel != "" {
+			r = rel + "/" + r
+		}
+		real := filepath.Join(seen[len(seen)-1], d.Name())
+		isDir := d.IsDir()
+		if d.Type()&fs.ModeSymlink != 0 {
+			switch l.links {
+			case SkipSymlinks:
+				continue
+			case RejectSymlinks:
+				if !yield(r, broken{l.rel(p), fmt.Errorf("%w: %s", ErrSymlink, l.rel(p))}) {
+					return false
+				}
+				continue
+			}
+			s, err := os.Stat(p)
+			if err == nil {
+				real, err = filepath.EvalSymlinks(p)
+			}
+			if err == nil && s.IsDir() && slices.Contains(seen, real) {
+				err = fmt.Errorf("%w: %s", ErrSymlinkLoop, l.rel(p))
 			}
-
-			rel, err := filepath.Rel(path, p)
 			if err != nil {
-				return err
+				if !yield(r, broken{l.rel(p), err}) {
+					return false
+				}
+				continue
 			}
-			if !yield(ToSlash(rel), entry{l, Clean(p[len(l)+1:])}) {
-				return filepath.SkipAll
+			isDir = s.IsDir()
+		}
+		if isDir {
+			if !l.walk(p, r, append(seen, real), yield) {
+				return false
 			}
-			return nil
-		})
+			continue
+		}
+		if !yield(r, entry{l, l.rel(p)}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l local) Stat(path string) (Kind, error) {
+	path, err := l.resolve(path, read)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Absent, nil
+		}
+		return Absent, err
+	}
+	s, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Absent, nil
+		}
+		return Absent, err
 	}
+	if s.IsDir() {
+		return Directory, nil
+	}
+	return Regular, nil
+}
+
+func (l local) ReadDir(path string) ([]DirEntry, error) {
+	path, err := l.resolve(path, read)
+	if err != nil {
+		return nil, err
+	}
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !s.IsDir() {
+		return nil, os.ErrInvalid
+	}
+	dir, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]DirEntry, 0, len(dir))
+	for _, e := range dir {
+		d := DirEntry{e.Name(), Regular}
+		if e.Type()&fs.ModeSymlink != 0 {
+			switch l.links {
+			case SkipSymlinks:
+				continue
+			case RejectSymlinks:
+				return nil, fmt.Errorf("%w: %s", ErrSymlink, l.rel(filepath.Join(path, e.Name())))
+			}
+			if s, err := os.Stat(filepath.Join(path, e.Name())); err == nil && s.IsDir() {
+				d.Kind = Directory
+			}
+		} else if e.IsDir() {
+			d.Kind = Directory
+		}
+		list = append(list, d)
+	}
+	return list, nil
 }
 
 func (l local) abs(path string) (string, error) {
-	p, err := filepath.Abs(filepath.Join(string(l), path))
+	p, err := filepath.Abs(filepath.Join(l.root, path))
 	if err != nil {
 		return "", err
 	}
-	if !strings.HasPrefix(p, string(l)) || len(p) > len(l) && p[len(l)] != filepath.Separator {
+	if !within(p, l.root) {
 		return "", fmt.Errorf("invalid file path %s", path)
 	}
 	return p, nil
 }
 
+func (l local) rel(path string) string {
+	if path == l.root {
+		return ""
+	}
+	return ToSlash(path[len(l.root)+1:])
+}
+
+const (
+	read   = iota
+	write  // the file itself is written, links are resolved up to the file
+	unlink // the directory entry is changed, links are resolved up to its parent
+)
+
+// resolve maps a tree path to a file path applying the symlink policy. Reads
+// may follow links anywhere, writes have to stay inside the root once the
+// links are resolved.
+func (l local) resolve(path string, op int) (string, error) {
+	if op != write && !norm.NFC.IsNormalString(path) {
+		// names are written in NFC, but may be in any form on disk
+		if p, err := l.abs(norm.NFC.String(path)); err == nil {
+			if _, err := os.Lstat(p); err == nil {
+				path = norm.NFC.String(path)
+			}
+		}
+	}
+	p, err := l.abs(path)
+	if err != nil {
+		return "", err
+	}
+	link, err := l.linked(p)
+	if err != nil || !link {
+		return p, err
+	}
+	switch l.links {
+	case SkipSymlinks:
+		if op == read {
+			return "", fmt.Errorf("%s: %w", Norm(path), os.ErrNotExist)
+		}
+		fallthrough
+	case RejectSymlinks:
+		return "", fmt.Errorf("%w: %s", ErrSymlink, Norm(path))
+	}
+	if op == read {
+		return p, nil
+	}
+	target := p
+	if op == unlink {
+		target = filepath.Dir(p)
+	}
+	root, err := realPath(l.root)
+	if err != nil {
+		return "", err
+	}
+	if target, err = realPath(target); err != nil {
+		return "", err
+	}
+	if !within(target, root) {
+		return "", fmt.Errorf("invalid file path %s: link leads outside the root", Norm(path))
+	}
+	return p, nil
+}
+
+// linked reports whether any element of the path below the root is a link.
+func (l local) linked(path string) (bool, error) {
+	if path == l.root {
+		return false, nil
+	}
+	p := l.root
+	for _, name := range strings.Split(path[len(l.root)+1:], string(filepath.Separator)) {
+		p = filepath.Join(p, name)
+		s, err := os.Lstat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return false, nil
+			}
+			return false, err
+		}
+		if s.Mode()&fs.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// realPath resolves the links of a path that may not exist yet, dangling
+// links included.
+func realPath(path string) (string, error) {
+	rest := ""
+	for i := 0; i < 255; i++ {
+		r, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(r, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		if target, err := os.Readlink(path); err == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			path = target
+			continue
+		}
+		dir, name := filepath.Split(path)
+		if dir = filepath.Clean(dir); dir == path {
+			return filepath.Join(path, rest), nil
+		}
+		path, rest = dir, filepath.Join(name, rest)
+	}
+	return "", fmt.Errorf("%w: %s", ErrSymlinkLoop, path)
+}
+
+func within(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root) && path[len(root)] == filepath.Separator
+}
+
 func (l local) Remove(path string, ln func(path string)) (err error) {
-	path, err = l.abs(path)
+	path, err = l.resolve(path, unlink)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
-	s, err := os.Stat(path)
+	s, err := os.Lstat(path)
 	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
 		return err
 	}
+	if path == l.root {
+		return l.removeDir(path, ln)
+	}
 	return l.remove(path, s.IsDir(), ln)
 }
 
@@ -129,36 +451,113 @@ func (l local) remove(path string, dir bool, ln func(path string)) error {
 		return err
 	}
 	if ln != nil && !dir {
-		ln(path[len(l)+1:])
+		ln(l.rel(path))
 	}
 	return nil
 }
 
+func (l local) Rename(old, new string) (err error) {
+	if new, err = ValidPath(l, new); err != nil {
+		return err
+	}
+	if err = CheckRename(l, Norm(old), new); err != nil {
+		return err
+	}
+	if old, err = l.resolve(old, unlink); err != nil {
+		return err
+	}
+	if new, err = l.resolve(new, unlink); err != nil {
+		return err
+	}
+	if old == l.root || new == l.root {
+		return os.ErrInvalid
+	}
+	if _, err = os.Stat(old); err != nil {
+		return err
+	}
+	dir, _ := filepath.Split(new)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	return os.Rename(old, new)
+}
+
 func (l local) Store(path string, data []byte) (e Entry, err error) {
-	path, err = l.abs(path)
+	if path, err = ValidPath(l, path); err != nil {
+		return nil, err
+	}
+	path, err = l.resolve(path, write)
 	if err != nil {
 		return nil, err
 	}
+	if path == l.root {
+		return nil, os.ErrInvalid
+	}
 	dir, _ := filepath.Split(path)
 	if dir != "" {
 		if err := os.MkdirAll(dir, 0770); err != nil {
 			return nil, err
 		}
 	}
-	if err := os.WriteFile(path, data, 0660); err != nil {
+	if err := WriteFile(path, data, 0660); err != nil {
 		return nil, err
 	}
-	return entry{l, Clean(path[len(l)+1:])}, nil
+	return entry{l, l.rel(path)}, nil
+}
+
+var localRules = PathRules{MaxName: 255}
+
+func init() {
+	if runtime.GOOS == "windows" {
+		localRules.Illegal = `<>:"|?*`
+		localRules.Control = true
+		localRules.Reserved = []string{"CON", "PRN", "AUX", "NUL"}
+		for i := '1'; i <= '9'; i++ {
+			localRules.Reserved = append(localRules.Reserved, "COM"+string(i), "LPT"+string(i))
+		}
+	}
+}
+
+func (l local) Rules() PathRules {
+	return localRules
 }
 
 func (l local) Put(e Entry) (Entry, error) {
-	return Store(l, e)
+	// the metadata is read first, e may be the entry being overwritten
+	mode, err := Mode(e)
+	if err != nil {
+		return nil, err
+	}
+	mt, err := ModTime(e)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := Store(l, e)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(l.root, stored.GetPath())
+	if mode != 0 {
+		if err := os.Chmod(path, mode.Perm()); err != nil {
+			return nil, err
+		}
+	}
+	if !mt.IsZero() {
+		if err := os.Chtimes(path, time.Time{}, mt); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
 }
 
 func LocalTree(dir string) (Tree, error) {
+	return LocalTreeLinks(dir, FollowSymlinks)
+}
+
+func LocalTreeLinks(dir string, links Symlinks) (Tree, error) {
 	dir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
-	return local(dir), nil
+	return local{dir, links}, nil
 }
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
 	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 //go:embed test/list-all.txt
@@ -155,6 +157,108 @@ func TestRemoveWithListener(t *testing.T) {
 	require.Equal(t, "dir2/file22.txt file01.txt file02.md", strings.Join(rem, " "))
 }
 
+func TestRename(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	loc, err := LocalTree("test/tmp")
+	require.NoError(t, err)
+
+	_, err = loc.Store("dir1/f1.txt", []byte("f1"))
+	require.NoError(t, err)
+
+	require.NoError(t, loc.Rename("dir1/f1.txt", "dir2/f2.txt"))
+	require.NoFileExists(t, "test/tmp/dir1/f1.txt")
+	require.FileExists(t, "test/tmp/dir2/f2.txt")
+
+	require.NoError(t, loc.Rename("dir2", "dir3/dir2"))
+	require.FileExists(t, "test/tmp/dir3/dir2/f2.txt")
+
+	require.ErrorIs(t, loc.Rename("dir2", "dir4"), os.ErrNotExist)
+}
+
+func TestPutMeta(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/src", 0770))
+
+	mt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.WriteFile("test/tmp/src/f1.sh", []byte("f1"), 0750))
+	require.NoError(t, os.Chtimes("test/tmp/src/f1.sh", time.Time{}, mt))
+
+	src, err := LocalTree("test/tmp/src")
+	require.NoError(t, err)
+	dst, err := LocalTree("test/tmp/dst")
+	require.NoError(t, err)
+
+	e, err := src.Get("f1.sh")
+	require.NoError(t, err)
+	_, err = dst.Put(e)
+	require.NoError(t, err)
+
+	s, err := os.Stat("test/tmp/dst/f1.sh")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0750), s.Mode().Perm())
+	require.True(t, mt.Equal(s.ModTime()))
+
+	e, err = dst.Get("f1.sh")
+	require.NoError(t, err)
+	h, err := Hash(e)
+	require.NoError(t, err)
+	require.Equal(t, crc32.ChecksumIEEE([]byte("f1")), h)
+}
+
+func TestSymlinks(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/root/dir", 0770))
+	require.NoError(t, os.MkdirAll("test/tmp/out", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/root/dir/f1.txt", []byte("f1"), 0660))
+	require.NoError(t, os.WriteFile("test/tmp/out/f2.txt", []byte("f2"), 0660))
+	require.NoError(t, os.Symlink("../out", "test/tmp/root/out"))
+	require.NoError(t, os.Symlink("..", "test/tmp/root/dir/loop"))
+
+	find := func(tree Tree) string {
+		var list []string
+		for p, e := range tree.Find("") {
+			if _, err := e.GetData(); err != nil {
+				p += "!"
+			}
+			list = append(list, p)
+		}
+		return strings.Join(list, " ")
+	}
+
+	follow, err := LocalTreeLinks("test/tmp/root", FollowSymlinks)
+	require.NoError(t, err)
+	require.Equal(t, "dir/f1.txt dir/loop! out/f2.txt", find(follow))
+	e, err := follow.Get("out/f2.txt")
+	require.NoError(t, err)
+	require.Equal(t, "out/f2.txt", e.GetPath())
+	_, err = follow.Store("out/f3.txt", []byte("f3"))
+	require.ErrorContains(t, err, "outside the root")
+	require.NoFileExists(t, "test/tmp/out/f3.txt")
+	require.NoError(t, follow.Remove("out", nil))
+	require.FileExists(t, "test/tmp/out/f2.txt")
+	require.NoError(t, os.Symlink("../out", "test/tmp/root/out"))
+
+	skip, err := LocalTreeLinks("test/tmp/root", SkipSymlinks)
+	require.NoError(t, err)
+	require.Equal(t, "dir/f1.txt", find(skip))
+	kind, err := skip.Stat("out/f2.txt")
+	require.NoError(t, err)
+	require.Equal(t, Absent, kind)
+	list, err := skip.ReadDir("")
+	require.NoError(t, err)
+	require.Equal(t, []DirEntry{{"dir", Directory}}, list)
+
+	reject, err := LocalTreeLinks("test/tmp/root", RejectSymlinks)
+	require.NoError(t, err)
+	require.Equal(t, "dir/f1.txt dir/loop! out!", find(reject))
+	_, err = reject.Get("out/f2.txt")
+	require.ErrorIs(t, err, ErrSymlink)
+	_, err = reject.ReadDir("")
+	require.ErrorIs(t, err, ErrSymlink)
+}
+
 func TestLookup(t *testing.T) {
 	loc, err := LocalTree("test/local")
 	require.NoError(t, err)
@@ -191,3 +295,29 @@ func readFile(path string) string {
 	data, _ := os.ReadFile(path)
 	return string(data)
 }
+
+func TestStatReadDir(t *testing.T) {
+	loc, err := LocalTree("test/local")
+	require.NoError(t, err)
+
+	kind, err := loc.Stat("dir1")
+	require.NoError(t, err)
+	require.Equal(t, Directory, kind)
+
+	kind, err = loc.Stat("dir1/file11.txt")
+	require.NoError(t, err)
+	require.Equal(t, Regular, kind)
+
+	kind, err = loc.Stat("dir3")
+	require.NoError(t, err)
+	require.Equal(t, Absent, kind)
+
+	list, err := loc.ReadDir("dir1")
+	require.NoError(t, err)
+	require.Equal(t, []DirEntry{
+		{"dir11", Directory}, {"dir12", Directory}, {"file11.txt", Regular}, {"file12.txt", Regular},
+	}, list)
+
+	_, err = loc.ReadDir("dir1/file11.txt")
+	require.ErrorIs(t, err, os.ErrInvalid)
+}
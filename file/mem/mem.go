@@ -1,16 +1,27 @@
 package mem
 
 import (
-	"errors"
+	"container/list"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"iter"
 	"os"
 	"packman/file"
 	"strings"
+	"time"
 )
 
 type entry struct {
-	path string
-	data []byte
+	path  string
+	data  []byte
+	size  int64
+	mtime time.Time
+	mode  fs.FileMode
+	crc   uint32
+	pool  *pool
+	spill string        // file holding the data once moved out of memory
+	elem  *list.Element // position in the pool while in memory
 }
 
 func (e *entry) String() string {
@@ -22,24 +33,59 @@ func (e *entry) GetPath() string {
 }
 
 func (e *entry) GetData() ([]byte, error) {
+	if e.pool != nil {
+		return e.pool.read(e)
+	}
 	return e.data, nil
 }
 
 func (e *entry) GetSize() (int64, error) {
-	return int64(len(e.data)), nil
+	return e.size, nil
+}
+
+func (e *entry) GetModTime() (time.Time, error) {
+	return e.mtime, nil
+}
+
+func (e *entry) GetMode() (fs.FileMode, error) {
+	return e.mode, nil
+}
+
+func (e *entry) GetHash() (uint32, error) {
+	if e.pool != nil {
+		return e.pool.hash(e)
+	}
+	if e.crc == 0 {
+		data, err := e.GetData()
+		if err != nil {
+			return 0, err
+		}
+		e.crc = crc32.ChecksumIEEE(data)
+	}
+	return e.crc, nil
 }
 
 type Store map[string]*entry
 
-func (s *Store) Pack() ([]byte, error) {
-	return nil, errors.ErrUnsupported
+func (s *Store) set(e *entry) {
+	if *s == nil {
+		*s = make(Store)
+	}
+	s.delete(e.path)
+	(*s)[e.path] = e
 }
 
-func cleanPath(path string) string {
-	if path = file.Clean(path); path == "/" || path == "" || path == "." {
-		return ""
+func (s *Store) delete(path string) {
+	if e, ok := (*s)[path]; ok {
+		delete(*s, path)
+		if e.pool != nil {
+			e.pool.release(e)
+		}
 	}
-	return path
+}
+
+func cleanPath(path string) string {
+	return file.Key(path)
 }
 
 func (s *Store) Get(path string) (file.Entry, error) {
@@ -49,6 +95,9 @@ func (s *Store) Get(path string) (file.Entry, error) {
 	if e, ok := (*s)[path]; ok {
 		return e, nil
 	}
+	if kind, _ := s.Stat(path); kind == file.Directory {
+		return nil, os.ErrInvalid
+	}
 	return nil, os.ErrNotExist
 }
 
@@ -78,20 +127,56 @@ func (s *Store) Find(path string) iter.Seq2[string, file.Entry] {
 	}
 }
 
+func (s *Store) Stat(path string) (file.Kind, error) {
+	if path = cleanPath(path); path == "" {
+		return file.Directory, nil
+	}
+	if _, ok := (*s)[path]; ok {
+		return file.Regular, nil
+	}
+	for p := range *s {
+		if strings.HasPrefix(p, path) && p[len(path)] == '/' {
+			return file.Directory, nil
+		}
+	}
+	return file.Absent, nil
+}
+
+func (s *Store) ReadDir(path string) ([]file.DirEntry, error) {
+	path = cleanPath(path)
+	if _, ok := (*s)[path]; ok {
+		return nil, os.ErrInvalid
+	}
+	children := make(map[string]file.Kind)
+	for p := range *s {
+		rel, ok := file.Base(p, path)
+		if !ok || path != "" && p[len(path)] != '/' {
+			continue
+		}
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			children[rel[:i]] = file.Directory
+		} else {
+			children[rel] = file.Regular
+		}
+	}
+	if len(children) == 0 && path != "" {
+		return nil, os.ErrNotExist
+	}
+	return file.DirEntries(children), nil
+}
+
 func (s *Store) Remove(path string, ln func(path string)) error {
 	if path = cleanPath(path); path == "" {
-		if ln != nil {
-			for p := range *s {
-				delete(*s, p)
+		for p := range *s {
+			s.delete(p)
+			if ln != nil {
 				ln(p)
 			}
-		} else {
-			clear(*s)
 		}
 		return nil
 	}
 	if _, ok := (*s)[path]; ok {
-		delete(*s, path)
+		s.delete(path)
 		if ln != nil {
 			ln(path)
 		}
@@ -99,7 +184,7 @@ func (s *Store) Remove(path string, ln func(path string)) error {
 	}
 	for p := range *s {
 		if strings.HasPrefix(p, path) && p[len(path)] == '/' {
-			delete(*s, p)
+			s.delete(p)
 			if ln != nil {
 				ln(p)
 			}
@@ -108,26 +193,165 @@ func (s *Store) Remove(path string, ln func(path string)) error {
 	return nil
 }
 
+func (s *Store) Rename(old, new string) error {
+	if old = cleanPath(old); old == "" {
+		return os.ErrInvalid
+	}
+	new, err := file.ValidPath(s, new)
+	if err != nil {
+		return err
+	}
+	if old == new {
+		return nil
+	}
+	if err := file.CheckRename(s, old, new); err != nil {
+		return err
+	}
+	if e, ok := (*s)[old]; ok {
+		delete(*s, old)
+		s.delete(new)
+		e.path = new
+		(*s)[new] = e
+		return nil
+	}
+	for p, e := range *s {
+		if strings.HasPrefix(p, old) && p[len(old)] == '/' {
+			delete(*s, p)
+			e.path = new + p[len(old):]
+			(*s)[e.path] = e
+		}
+	}
+	return nil
+}
+
 func (s *Store) Store(path string, data []byte) (file.Entry, error) {
-	if path = cleanPath(path); path == "" {
-		return nil, os.ErrInvalid
+	path, err := file.ValidPath(s, path)
+	if err != nil {
+		return nil, err
 	}
 	return s.store(path, data), nil
 }
 
 func (s *Store) store(path string, data []byte) *entry {
-	e := &entry{path, data}
-	(*s)[path] = e
+	e := newEntry(path, data)
+	s.set(e)
 	return e
 }
 
+func newEntry(path string, data []byte) *entry {
+	return &entry{path: path, data: data, size: int64(len(data)), mtime: time.Now()}
+}
+
 func (s *Store) Put(e file.Entry) (file.Entry, error) {
-	if t, ok := e.(*entry); ok {
-		return s.Store(t.path, t.data)
+	c, err := copyEntry(s, e)
+	if err != nil {
+		return nil, err
+	}
+	s.set(c)
+	return c, nil
+}
+
+// copyEntry reads e into a new entry at its path valid in t.
+func copyEntry(t file.Tree, e file.Entry) (*entry, error) {
+	path, err := file.ValidPath(t, e.GetPath())
+	if err != nil {
+		return nil, err
 	}
 	data, err := e.GetData()
 	if err != nil {
 		return nil, err
 	}
-	return s.Store(e.GetPath(), data)
+	c := &entry{path: path, data: data, size: int64(len(data))}
+	if c.mtime, err = file.ModTime(e); err != nil {
+		return nil, err
+	}
+	if c.mode, err = file.Mode(e); err != nil {
+		return nil, err
+	}
+	if c.mtime.IsZero() {
+		c.mtime = time.Now()
+	}
+	switch t := e.(type) {
+	case *entry:
+		if t.pool == nil {
+			c.crc = t.crc
+		}
+	case *file.Loaded:
+		c.crc = t.CRC
+	}
+	return c, nil
+}
+
+// BoundedStore is a Store keeping at most a budget of data in memory.
+type BoundedStore struct {
+	files Store
+	pool  *pool
+}
+
+// Bounded returns a store keeping at most budget bytes of data in memory.
+// Files over a quarter of the budget and then the least recently read ones
+// are moved to a temp directory, which Close removes.
+func Bounded(budget int64) *BoundedStore {
+	return &BoundedStore{files: make(Store), pool: &pool{budget: budget}}
+}
+
+func (b *BoundedStore) Close() error {
+	return b.pool.close()
+}
+
+func (b *BoundedStore) add(e *entry) (file.Entry, error) {
+	b.files.set(e)
+	if err := b.pool.add(e); err != nil {
+		b.files.delete(e.path)
+		return nil, err
+	}
+	return e, nil
+}
+
+func (b *BoundedStore) Pack() ([]byte, error) {
+	return b.files.Pack()
+}
+
+func (b *BoundedStore) WriteTo(w io.Writer) (int64, error) {
+	return b.files.WriteTo(w)
+}
+
+func (b *BoundedStore) Get(path string) (file.Entry, error) {
+	return b.files.Get(path)
+}
+
+func (b *BoundedStore) Find(path string) iter.Seq2[string, file.Entry] {
+	return b.files.Find(path)
+}
+
+func (b *BoundedStore) Stat(path string) (file.Kind, error) {
+	return b.files.Stat(path)
+}
+
+func (b *BoundedStore) ReadDir(path string) ([]file.DirEntry, error) {
+	return b.files.ReadDir(path)
+}
+
+func (b *BoundedStore) Remove(path string, ln func(path string)) error {
+	return b.files.Remove(path, ln)
+}
+
+func (b *BoundedStore) Rename(old, new string) error {
+	return b.files.Rename(old, new)
+}
+
+func (b *BoundedStore) Store(path string, data []byte) (file.Entry, error) {
+	path, err := file.ValidPath(b, path)
+	if err != nil {
+		return nil, err
+	}
+	return b.add(newEntry(path, data))
+}
+
+func (b *BoundedStore) Put(e file.Entry) (file.Entry, error) {
+	c, err := copyEntry(b, e)
+	if err != nil {
+		return nil, err
+	}
+	return b.add(c)
 }
@@ -2,11 +2,19 @@ package mem
 
 import (
 	_ "embed"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/fs"
 	"maps"
+	"os"
+	"packman/file"
+	"packman/file/filetest"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 //go:embed test/list-all.txt
@@ -98,6 +106,192 @@ func TestPut(t *testing.T) {
 	require.Equal(t, s, d)
 }
 
+func TestStatReadDir(t *testing.T) {
+	s := prepareStore()
+
+	kind, err := s.Stat("dir1")
+	require.NoError(t, err)
+	require.Equal(t, file.Directory, kind)
+
+	kind, err = s.Stat("dir1/file11.txt")
+	require.NoError(t, err)
+	require.Equal(t, file.Regular, kind)
+
+	kind, err = s.Stat("dir")
+	require.NoError(t, err)
+	require.Equal(t, file.Absent, kind)
+
+	list, err := s.ReadDir("")
+	require.NoError(t, err)
+	require.Equal(t, "dir1/ dir2/ file01.txt file02.md", dirNames(list))
+
+	list, err = s.ReadDir("dir1/")
+	require.NoError(t, err)
+	require.Equal(t, "dir11/ dir12/ file11.txt file12.txt", dirNames(list))
+
+	_, err = s.ReadDir("dir3")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRename(t *testing.T) {
+	s := prepareStore()
+
+	require.NoError(t, s.Rename("dir1/file11.txt", "dir3/file31.txt"))
+	require.Equal(t, "file22.txt", find(s, "dir2"))
+	require.Equal(t, "file31.txt", find(s, "dir3"))
+
+	require.NoError(t, s.Rename("dir1", "dir4/dir1"))
+	require.Equal(t, "dir1/dir11/file111.md\ndir1/dir12/file121.txt\ndir1/file12.txt", find(s, "dir4"))
+	require.Equal(t, "", find(s, "dir1"))
+
+	e, err := s.Get("dir4/dir1/file12.txt")
+	require.NoError(t, err)
+	require.Equal(t, "dir4/dir1/file12.txt", e.GetPath())
+
+	require.ErrorIs(t, s.Rename("dir1", "dir5"), os.ErrNotExist)
+}
+
+func TestConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		s := make(Store)
+		for p, data := range files {
+			_, err := s.Store(p, []byte(data))
+			require.NoError(t, err)
+		}
+		return &s
+	})
+}
+
+func TestBoundedConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		s := Bounded(16)
+		t.Cleanup(func() {
+			require.NoError(t, s.Close())
+		})
+		for p, data := range files {
+			_, err := s.Store(p, []byte(data))
+			require.NoError(t, err)
+		}
+		return s
+	})
+}
+
+func TestBounded(t *testing.T) {
+	s := Bounded(40)
+	store := func(path string, size int) {
+		_, err := s.Store(path, []byte(strings.Repeat(path, size)))
+		require.NoError(t, err)
+	}
+	store("a", 8)
+	store("b", 9)
+	store("c", 10)
+	read(t, s, "a")
+	store("d", 10)
+	require.Equal(t, int64(37), s.pool.used)
+
+	// e evicts the least recently read b, f is too large to be kept at all
+	store("e", 8)
+	store("f", 11)
+	require.Equal(t, int64(36), s.pool.used)
+	require.NotEmpty(t, s.files["b"].spill)
+	require.NotEmpty(t, s.files["f"].spill)
+	require.Empty(t, s.files["a"].spill)
+	require.Empty(t, s.files["c"].spill)
+
+	for _, p := range []string{"a", "b", "c", "d", "e", "f"} {
+		size, err := s.files[p].GetSize()
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat(p, int(size)), read(t, s, p))
+	}
+
+	spilled := s.files["b"].spill
+	require.NoError(t, s.Remove("b", nil))
+	require.NoFileExists(t, spilled)
+	require.NoError(t, s.Rename("f", "x/f"))
+	require.Equal(t, strings.Repeat("f", 11), read(t, s, "x/f"))
+
+	data, err := s.Pack()
+	require.NoError(t, err)
+	c, err := Parse(data)
+	require.NoError(t, err)
+	require.Equal(t, "a\nc\nd\ne\nx/f", find(c, ""))
+	require.Equal(t, strings.Repeat("f", 11), read(t, &c, "x/f"))
+
+	dir := s.pool.dir
+	require.DirExists(t, dir)
+	require.NoError(t, s.Close())
+	require.NoDirExists(t, dir)
+}
+
+func TestBoundedConcurrent(t *testing.T) {
+	s := Bounded(16)
+	defer s.Close()
+	var entries []file.Entry
+	for i := range 8 {
+		e, err := s.Store(strconv.Itoa(i), []byte(strings.Repeat(strconv.Itoa(i), 6)))
+		require.NoError(t, err)
+		entries = append(entries, e)
+	}
+	var wg sync.WaitGroup
+	for range 4 {
+		for _, e := range entries {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := file.Hash(e)
+				assert.NoError(t, err)
+				_, err = e.GetData()
+				assert.NoError(t, err)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func TestFindSorted(t *testing.T) {
+	s := prepareStore()
+	var files []string
+	for p := range file.FindSorted(&s, "") {
+		files = append(files, p)
+	}
+	require.Equal(t, "dir1/dir11/file111.md dir1/dir12/file121.txt dir1/file11.txt dir1/file12.txt dir2/file22.txt file01.txt file02.md", strings.Join(files, " "))
+}
+
+func TestSnapshot(t *testing.T) {
+	s := prepareStore()
+	_, err := s.Put(stub{"exec.sh", 0750})
+	require.NoError(t, err)
+	data, err := s.Pack()
+	require.NoError(t, err)
+
+	c, err := Parse(data)
+	require.NoError(t, err)
+	require.Equal(t, find(s, ""), find(c, ""))
+	require.Equal(t, readAll(s), readAll(c))
+	for p, e := range s {
+		require.True(t, e.mtime.Equal(c[p].mtime), p)
+		require.Equal(t, e.mode, c[p].mode, p)
+	}
+	again, err := c.Pack()
+	require.NoError(t, err)
+	require.Equal(t, data, again)
+
+	empty := make(Store)
+	data, err = empty.Pack()
+	require.NoError(t, err)
+	c, err = Parse(data)
+	require.NoError(t, err)
+	require.Empty(t, c)
+
+	_, err = Parse([]byte("PK\x03\x04...."))
+	require.ErrorIs(t, err, ErrNotSnapshot)
+	data, err = s.Pack()
+	require.NoError(t, err)
+	data[len(data)/2]++
+	_, err = Parse(data)
+	require.ErrorIs(t, err, ErrFileCorrupted)
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // Supplementary classes & routines                                                                               //
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -131,3 +325,54 @@ func readAll(s Store) string {
 	slices.Sort(data)
 	return strings.Join(data, " ")
 }
+
+func dirNames(list []file.DirEntry) string {
+	names := make([]string, len(list))
+	for i, e := range list {
+		if names[i] = e.Name; e.Kind == file.Directory {
+			names[i] += "/"
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+type stub struct {
+	path string
+	mode fs.FileMode
+}
+
+func (s stub) String() string {
+	return s.path
+}
+
+func (s stub) GetPath() string {
+	return s.path
+}
+
+func (s stub) GetData() ([]byte, error) {
+	return []byte(s.path), nil
+}
+
+func (s stub) GetSize() (int64, error) {
+	return int64(len(s.path)), nil
+}
+
+func (s stub) GetModTime() (time.Time, error) {
+	return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), nil
+}
+
+func (s stub) GetMode() (fs.FileMode, error) {
+	return s.mode, nil
+}
+
+func (s stub) GetHash() (uint32, error) {
+	return 0, nil
+}
+
+func read(t *testing.T, s file.Tree, path string) string {
+	e, err := s.Get(path)
+	require.NoError(t, err)
+	data, err := e.GetData()
+	require.NoError(t, err)
+	return string(data)
+}
@@ -0,0 +1,137 @@
+package mem
+
+import (
+	"container/list"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// pool keeps the data of a bounded store within its budget by writing files
+// out to a temp directory. It is safe for concurrent reads.
+type pool struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	lru    list.List // entries in memory, the most recently read first
+	dir    string
+}
+
+func (p *pool) add(e *entry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.pool = p
+	if e.size > p.budget/4 {
+		return p.spill(e)
+	}
+	e.elem = p.lru.PushFront(e)
+	p.used += e.size
+	for p.used > p.budget {
+		if err := p.spill(p.lru.Back().Value.(*entry)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pool) spill(e *entry) error {
+	if p.dir == "" {
+		dir, err := os.MkdirTemp("", "packman-")
+		if err != nil {
+			return err
+		}
+		p.dir = dir
+	}
+	f, err := os.CreateTemp(p.dir, "")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(e.data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return err
+	}
+	if e.elem != nil {
+		p.lru.Remove(e.elem)
+		p.used -= e.size
+		e.elem = nil
+	}
+	e.spill, e.data = f.Name(), nil
+	return nil
+}
+
+// open returns the data of e in memory or else its spilled file. The file is
+// opened under the lock, so release can't remove it first, and read without.
+func (p *pool) open(e *entry) ([]byte, *os.File, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.spill == "" {
+		if e.elem != nil {
+			p.lru.MoveToFront(e.elem)
+		}
+		return e.data, nil, nil
+	}
+	f, err := os.Open(e.spill)
+	return nil, f, err
+}
+
+func (p *pool) read(e *entry) ([]byte, error) {
+	data, f, err := p.open(e)
+	if f == nil || err != nil {
+		return data, err
+	}
+	defer f.Close()
+	data = make([]byte, e.size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (p *pool) hash(e *entry) (uint32, error) {
+	p.mu.Lock()
+	crc := e.crc
+	p.mu.Unlock()
+	if crc != 0 {
+		return crc, nil
+	}
+	data, err := p.read(e)
+	if err != nil {
+		return 0, err
+	}
+	crc = crc32.ChecksumIEEE(data)
+	p.mu.Lock()
+	e.crc = crc
+	p.mu.Unlock()
+	return crc, nil
+}
+
+func (p *pool) release(e *entry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e.elem != nil {
+		p.lru.Remove(e.elem)
+		p.used -= e.size
+		e.elem = nil
+	}
+	if e.spill != "" {
+		_ = os.Remove(e.spill)
+	}
+}
+
+func (p *pool) close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lru.Init()
+	p.used = 0
+	if p.dir == "" {
+		return nil
+	}
+	dir := p.dir
+	p.dir = ""
+	return os.RemoveAll(dir)
+}
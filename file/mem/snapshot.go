@@ -0,0 +1,166 @@
+package mem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"packman/file"
+	"slices"
+	"time"
+)
+
+var (
+	ErrNotSnapshot   = errors.New("not a snapshot file")
+	ErrFileCorrupted = errors.New("file corrupted")
+)
+
+// A snapshot holds the magic, the number of entries and then every entry
+// ordered by path as the path, mode, modification time and data, integers
+// being varints and strings prefixed by their length. A CRC32 of all that
+// closes the file.
+var magic = []byte("PMS\x01")
+
+// Pack returns the snapshot of the store.
+func (s *Store) Pack() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the snapshot of the store, streaming spilled files from disk
+// one at a time.
+func (s *Store) WriteTo(w io.Writer) (int64, error) {
+	crc := crc32.NewIEEE()
+	cw := &countWriter{w: io.MultiWriter(w, crc)}
+	buf := slices.Clone(magic)
+	buf = binary.AppendUvarint(buf, uint64(len(*s)))
+	for _, p := range slices.Sorted(maps.Keys(*s)) {
+		e := (*s)[p]
+		buf = binary.AppendUvarint(buf, uint64(len(p)))
+		buf = append(buf, p...)
+		buf = binary.AppendUvarint(buf, uint64(e.mode))
+		var mtime int64
+		if !e.mtime.IsZero() {
+			mtime = e.mtime.UnixNano()
+		}
+		buf = binary.AppendVarint(buf, mtime)
+		buf = binary.AppendUvarint(buf, uint64(e.size))
+		if _, err := cw.Write(buf); err != nil {
+			return cw.n, err
+		}
+		buf = buf[:0]
+		if err := e.writeData(cw); err != nil {
+			return cw.n, err
+		}
+	}
+	if _, err := cw.Write(buf); err != nil {
+		return cw.n, err
+	}
+	n, err := w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return cw.n + int64(n), err
+}
+
+func (e *entry) writeData(w io.Writer) error {
+	if e.pool == nil {
+		_, err := w.Write(e.data)
+		return err
+	}
+	data, f, err := e.pool.open(e)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		_, err = w.Write(data)
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(w, f, e.size)
+	return err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func Read(path string) (file.Tree, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Parse reads a snapshot into a store without a memory budget.
+func Parse(data []byte) (Store, error) {
+	if len(data) < len(magic)+4 || string(data[:len(magic)]) != string(magic) {
+		return nil, ErrNotSnapshot
+	}
+	end := len(data) - 4
+	if crc32.ChecksumIEEE(data[:end]) != binary.LittleEndian.Uint32(data[end:]) {
+		return nil, ErrFileCorrupted
+	}
+	buf := data[len(magic):end]
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			buf = nil
+			return 0
+		}
+		buf = buf[n:]
+		return v
+	}
+	bytes := func() []byte {
+		n := uvarint()
+		if n > uint64(len(buf)) {
+			buf = nil
+			return nil
+		}
+		b := buf[:n:n]
+		buf = buf[n:]
+		return b
+	}
+
+	count := uvarint()
+	s := make(Store, min(count, uint64(len(buf))))
+	for range count {
+		if len(buf) == 0 {
+			return nil, ErrFileCorrupted
+		}
+		e := &entry{path: string(bytes())}
+		e.mode = fs.FileMode(uvarint())
+		mtime, n := binary.Varint(buf)
+		if n <= 0 {
+			return nil, ErrFileCorrupted
+		}
+		if buf = buf[n:]; mtime != 0 {
+			e.mtime = time.Unix(0, mtime)
+		}
+		e.data = bytes()
+		if e.size = int64(len(e.data)); buf == nil || e.path == "" {
+			return nil, ErrFileCorrupted
+		}
+		s[e.path] = e
+	}
+	if len(buf) != 0 {
+		return nil, ErrFileCorrupted
+	}
+	return s, nil
+}
@@ -0,0 +1,40 @@
+package file
+
+import (
+	"hash/crc32"
+	"io/fs"
+	"time"
+)
+
+// Meta is implemented by entries that can describe themselves without reading
+// the data. A zero time or mode means the backend doesn't keep it.
+type Meta interface {
+	GetModTime() (time.Time, error)
+	GetMode() (fs.FileMode, error)
+	GetHash() (uint32, error)
+}
+
+func Hash(e Entry) (uint32, error) {
+	if m, ok := e.(Meta); ok {
+		return m.GetHash()
+	}
+	data, err := e.GetData()
+	if err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(data), nil
+}
+
+func ModTime(e Entry) (time.Time, error) {
+	if m, ok := e.(Meta); ok {
+		return m.GetModTime()
+	}
+	return time.Time{}, nil
+}
+
+func Mode(e Entry) (fs.FileMode, error) {
+	if m, ok := e.(Meta); ok {
+		return m.GetMode()
+	}
+	return 0, nil
+}
@@ -0,0 +1,123 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"slices"
+)
+
+type MirrorOptions struct {
+	// Exclude lists glob patterns, relative to the destination directory, of
+	// paths that are neither overwritten nor removed.
+	Exclude []string
+	// DryRun only reports the changes.
+	DryRun bool
+	Jobs   int
+}
+
+// Mirror makes the directory dstDir of dst hold exactly the files of srcDir
+// of src. Only added and modified files are copied and files missing in src
+// are removed. The changes are returned relative to the directories.
+func Mirror(dst Tree, dstDir string, src Tree, srcDir string, opts MirrorOptions) ([]Delta, error) {
+	for _, p := range opts.Exclude {
+		if err := ValidPattern(p); err != nil {
+			return nil, err
+		}
+	}
+	switch kind, err := src.Stat(srcDir); {
+	case err != nil:
+		return nil, err
+	case kind == Absent:
+		return nil, fmt.Errorf("%s: %w", srcDir, os.ErrNotExist)
+	case kind == Regular:
+		return nil, fmt.Errorf("%s: %w", srcDir, os.ErrInvalid)
+	}
+	if kind, err := dst.Stat(dstDir); err != nil {
+		return nil, err
+	} else if kind == Regular {
+		return nil, fmt.Errorf("%s: %w", dstDir, os.ErrInvalid)
+	}
+
+	all, err := diff(dst.Find(dstDir), src.Find(srcDir))
+	if err != nil {
+		return nil, err
+	}
+	var list []Delta
+	for _, d := range all {
+		if excluded, err := matchAny(opts.Exclude, d.Path); err != nil {
+			return nil, err
+		} else if !excluded {
+			list = append(list, d)
+		}
+	}
+	if opts.DryRun {
+		return list, nil
+	}
+
+	// extras are removed once the copy succeeded, except for those in the
+	// way of a copied path
+	var removed, blocking []string
+	for _, d := range list {
+		if d.Change == Removed {
+			removed = append(removed, d.Path)
+		}
+	}
+	for _, d := range list {
+		if d.Change == Removed {
+			continue
+		}
+		for i := 0; i < len(removed); i++ {
+			if r := removed[i]; under(d.Path, r) || under(r, d.Path) {
+				blocking = append(blocking, r)
+				removed = slices.Delete(removed, i, i+1)
+				i--
+			}
+		}
+	}
+	remove := func(paths []string) error {
+		for _, p := range paths {
+			if err := dst.Remove(Join(dstDir, p), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := remove(blocking); err != nil {
+		return nil, err
+	}
+	entries := func(yield func(string, Entry) bool) {
+		for _, d := range list {
+			if d.Change == Removed {
+				continue
+			}
+			e, err := src.Get(Join(srcDir, d.Path))
+			if err != nil {
+				e = broken{d.Path, err}
+			}
+			if !yield(Join(dstDir, d.Path), e) {
+				return
+			}
+		}
+	}
+	if err := Copy(dst, entries, opts.Jobs, nil); err != nil {
+		return nil, err
+	}
+	if err := remove(removed); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// under tells if path lies below the directory dir.
+func under(path, dir string) bool {
+	return len(path) > len(dir) && path[len(dir)] == '/' && path[:len(dir)] == dir
+}
+
+func matchAny(patterns []string, path string) (bool, error) {
+	for _, p := range patterns {
+		if ok, err := Match(p, path); ok || err != nil {
+			return ok, err
+		}
+	}
+	return false, nil
+}
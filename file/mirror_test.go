@@ -0,0 +1,94 @@
+package file_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"packman/file"
+	"packman/file/mem"
+	"testing"
+)
+
+func TestMirror(t *testing.T) {
+	src := make(mem.Store)
+	dst := make(mem.Store)
+	for p, data := range map[string]string{"a/same": "1", "a/new": "2", "a/mod": "3", "b": "4"} {
+		_, err := src.Store(p, []byte(data))
+		require.NoError(t, err)
+	}
+	for p, data := range map[string]string{"x/same": "1", "x/mod": "0", "x/old": "5", "x/keep/cfg": "6", "y": "7"} {
+		_, err := dst.Store(p, []byte(data))
+		require.NoError(t, err)
+	}
+	exp := []file.Delta{
+		{"mod", file.Modified},
+		{"new", file.Added},
+		{"old", file.Removed},
+	}
+	opts := file.MirrorOptions{Exclude: []string{"keep/**"}, DryRun: true}
+
+	list, err := file.Mirror(&dst, "x", &src, "a", opts)
+	require.NoError(t, err)
+	require.Equal(t, exp, list)
+	require.Equal(t, []string{"x/keep/cfg", "x/mod", "x/old", "x/same", "y"}, paths(&dst))
+
+	opts.DryRun = false
+	list, err = file.Mirror(&dst, "x", &src, "a", opts)
+	require.NoError(t, err)
+	require.Equal(t, exp, list)
+	require.Equal(t, []string{"x/keep/cfg", "x/mod", "x/new", "x/same", "y"}, paths(&dst))
+	e, err := dst.Get("x/mod")
+	require.NoError(t, err)
+	data, err := e.GetData()
+	require.NoError(t, err)
+	require.Equal(t, "3", string(data))
+
+	list, err = file.Mirror(&dst, "x", &src, "a", opts)
+	require.NoError(t, err)
+	require.Empty(t, list)
+
+	_, err = src.Store("a/bad", nil)
+	require.NoError(t, err)
+	_, err = dst.Store("x/old", []byte("5"))
+	require.NoError(t, err)
+	_, err = file.Mirror(&dst, "x", failingGet{&src, "a/bad"}, "a", opts)
+	require.EqualError(t, err, "read failed")
+	require.Equal(t, []string{"x/keep/cfg", "x/mod", "x/new", "x/old", "x/same", "y"}, paths(&dst))
+	require.NoError(t, src.Remove("a/bad", nil))
+
+	// a file in the way of a copied directory goes first
+	_, err = src.Store("a/old/file", []byte("8"))
+	require.NoError(t, err)
+	list, err = file.Mirror(&dst, "x", &src, "a", opts)
+	require.NoError(t, err)
+	require.Equal(t, []file.Delta{{"old", file.Removed}, {"old/file", file.Added}}, list)
+	require.Equal(t, []string{"x/keep/cfg", "x/mod", "x/new", "x/old/file", "x/same", "y"}, paths(&dst))
+
+	_, err = file.Mirror(&dst, "x", &src, "none", opts)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = file.Mirror(&dst, "x", &src, "b", opts)
+	require.ErrorIs(t, err, os.ErrInvalid)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+// Supplementary classes & routines                                                                               //
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+
+func paths(t file.Tree) []string {
+	var list []string
+	for p := range file.FindSorted(t, "") {
+		list = append(list, p)
+	}
+	return list
+}
+
+type failingGet struct {
+	file.Tree
+	path string
+}
+
+func (f failingGet) Get(path string) (file.Entry, error) {
+	if path == f.path {
+		return failing(path), nil
+	}
+	return f.Tree.Get(path)
+}
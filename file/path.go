@@ -21,6 +21,13 @@ func Clean(path string) string {
 	return ToSlash(filepath.Clean(path))
 }
 
+func Norm(path string) string {
+	if path = strings.Trim(Clean(path), "/"); path == "." {
+		return ""
+	}
+	return path
+}
+
 func Base(path, base string) (rel string, ok bool) {
 	if ok = len(path) >= len(base) && path[:len(base)] == base; ok {
 		rel = path[len(base):]
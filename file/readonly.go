@@ -0,0 +1,29 @@
+package file
+
+type readOnly struct {
+	Tree
+}
+
+// ReadOnly wraps a tree failing every write with ErrReadOnly.
+func ReadOnly(t Tree) Tree {
+	if r, ok := t.(readOnly); ok {
+		return r
+	}
+	return readOnly{t}
+}
+
+func (r readOnly) Remove(string, func(path string)) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Rename(string, string) error {
+	return ErrReadOnly
+}
+
+func (r readOnly) Store(string, []byte) (Entry, error) {
+	return nil, ErrReadOnly
+}
+
+func (r readOnly) Put(Entry) (Entry, error) {
+	return nil, ErrReadOnly
+}
@@ -0,0 +1,77 @@
+package file
+
+import (
+	"cmp"
+	"path"
+	"slices"
+	"strings"
+)
+
+type Group struct {
+	Name  string `json:"name"`
+	Files int    `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type Size struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type Stats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Exts groups the files by lower case extension without the dot and Dirs
+	// by top-level directory, "" being the root. Both are ordered by size.
+	Exts    []Group `json:"exts"`
+	Dirs    []Group `json:"dirs"`
+	Largest []Size  `json:"largest"`
+}
+
+// Summarize aggregates the sizes of every file in the tree and lists the top
+// largest files.
+func Summarize(t Tree, top int) (Stats, error) {
+	var s Stats
+	exts, dirs := make(map[string]*Group), make(map[string]*Group)
+	add := func(groups map[string]*Group, name string, size int64) {
+		g, ok := groups[name]
+		if !ok {
+			g = &Group{Name: name}
+			groups[name] = g
+		}
+		g.Files++
+		g.Bytes += size
+	}
+	for p, e := range t.Find("") {
+		size, err := e.GetSize()
+		if err != nil {
+			return s, err
+		}
+		s.Files++
+		s.Bytes += size
+		add(exts, strings.ToLower(strings.TrimPrefix(path.Ext(p), ".")), size)
+		dir, _, _ := strings.Cut(p, "/")
+		if dir == p {
+			dir = ""
+		}
+		add(dirs, dir, size)
+		s.Largest = append(s.Largest, Size{p, size})
+	}
+	s.Exts, s.Dirs = groups(exts), groups(dirs)
+	slices.SortFunc(s.Largest, func(a, b Size) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Path, b.Path))
+	})
+	s.Largest = s.Largest[:min(max(top, 0), len(s.Largest))]
+	return s, nil
+}
+
+func groups(m map[string]*Group) []Group {
+	list := make([]Group, 0, len(m))
+	for _, g := range m {
+		list = append(list, *g)
+	}
+	slices.SortFunc(list, func(a, b Group) int {
+		return cmp.Or(cmp.Compare(b.Bytes, a.Bytes), strings.Compare(a.Name, b.Name))
+	})
+	return list
+}
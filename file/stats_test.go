@@ -0,0 +1,40 @@
+package file_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"packman/file"
+	"packman/file/vpk"
+	"testing"
+)
+
+func TestSummarize(t *testing.T) {
+	var tree vpk.Tree
+	for p, data := range map[string]string{
+		"a.txt": "1", "b.TXT": "22", "m/x.vmt": "333", "m/y/z.vmt": "4444", "s/noext": "55555",
+	} {
+		_, err := tree.Store(p, []byte(data))
+		require.NoError(t, err)
+	}
+
+	s, err := file.Summarize(&tree, 2)
+	require.NoError(t, err)
+	require.Equal(t, file.Stats{
+		Files: 5,
+		Bytes: 15,
+		Exts: []file.Group{
+			{Name: "vmt", Files: 2, Bytes: 7},
+			{Name: "", Files: 1, Bytes: 5},
+			{Name: "txt", Files: 2, Bytes: 3},
+		},
+		Dirs: []file.Group{
+			{Name: "m", Files: 2, Bytes: 7},
+			{Name: "s", Files: 1, Bytes: 5},
+			{Name: "", Files: 2, Bytes: 3},
+		},
+		Largest: []file.Size{{Path: "s/noext", Bytes: 5}, {Path: "m/y/z.vmt", Bytes: 4}},
+	}, s)
+
+	s, err = file.Summarize(&tree, 0)
+	require.NoError(t, err)
+	require.Empty(t, s.Largest)
+}
@@ -0,0 +1,110 @@
+package file
+
+import (
+	"iter"
+	"sync"
+)
+
+type synchronized struct {
+	mu   sync.RWMutex
+	tree Tree
+}
+
+// Synchronized makes a tree safe for concurrent use. Find works on a snapshot,
+// so the loop body may modify the tree.
+func Synchronized(t Tree) Tree {
+	if s, ok := t.(*synchronized); ok {
+		return s
+	}
+	return &synchronized{tree: t}
+}
+
+func (s *synchronized) Pack() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Pack()
+}
+
+func (s *synchronized) Get(path string) (Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Get(path)
+}
+
+func (s *synchronized) Find(path string) iter.Seq2[string, Entry] {
+	return func(yield func(string, Entry) bool) {
+		type match struct {
+			path string
+			e    Entry
+		}
+		var list []match
+		s.mu.RLock()
+		for p, e := range s.tree.Find(path) {
+			list = append(list, match{p, e})
+		}
+		s.mu.RUnlock()
+		for _, m := range list {
+			if !yield(m.path, m.e) {
+				return
+			}
+		}
+	}
+}
+
+func (s *synchronized) Stat(path string) (Kind, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.Stat(path)
+}
+
+func (s *synchronized) ReadDir(path string) ([]DirEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tree.ReadDir(path)
+}
+
+func (s *synchronized) Remove(path string, ln func(path string)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Remove(path, ln)
+}
+
+func (s *synchronized) Rename(old, new string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Rename(old, new)
+}
+
+func (s *synchronized) Store(path string, data []byte) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Store(path, data)
+}
+
+func (s *synchronized) Put(e Entry) (Entry, error) {
+	l, err := Load(e)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tree.Put(l)
+}
+
+func (s *synchronized) Rules() PathRules {
+	return Rules(s.tree)
+}
+
+// Unwrap returns the tree under the Synchronized and ReadOnly wrappers.
+func Unwrap(t Tree) Tree {
+	for {
+		switch w := t.(type) {
+		case *synchronized:
+			t = w.tree
+		case readOnly:
+			t = w.Tree
+		default:
+			return t
+		}
+	}
+}
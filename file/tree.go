@@ -1,12 +1,42 @@
 package file
 
-import "iter"
+import (
+	"iter"
+	"os"
+	"slices"
+	"strings"
+)
 
+// Tree is a hierarchy of files addressed by slash-separated paths relative to
+// its root. Leading and trailing slashes are ignored and "", "." and "/" all
+// name the root. Implementations agree on the following:
+//
+//   - Get returns os.ErrNotExist for a missing path and os.ErrInvalid for a
+//     directory, including the root.
+//   - Find yields every file under a directory with paths relative to it, a
+//     single "." entry for a file, and nothing for a missing path.
+//   - Stat reports Absent without an error for a missing path.
+//   - ReadDir returns os.ErrNotExist for a missing path and os.ErrInvalid for
+//     a file. The root always exists.
+//   - Remove of a missing path is a no-op, removing the root empties the tree.
+//   - Store and Rename return os.ErrInvalid for the root and Rename returns
+//     os.ErrNotExist for a missing source.
+//   - Rename replaces a file at the new path. It returns os.ErrExist if the
+//     new path is a directory, is a file and the old one a directory, or lies
+//     below a file, and os.ErrInvalid for moving a directory into itself.
+//   - Store, Put and Rename fail with a *PathError, which is os.ErrInvalid,
+//     for a path breaking the rules of the tree, see Rules.
+//   - Read-only trees fail every write with ErrReadOnly.
+//
+// The filetest package checks an implementation against these rules.
 type Tree interface {
 	Pack() ([]byte, error)
 	Get(path string) (Entry, error)
 	Find(path string) iter.Seq2[string, Entry]
+	Stat(path string) (Kind, error)
+	ReadDir(path string) ([]DirEntry, error)
 	Remove(path string, ln func(path string)) error
+	Rename(old, new string) error
 	Store(path string, data []byte) (Entry, error)
 	Put(e Entry) (Entry, error)
 }
@@ -18,6 +48,41 @@ type Entry interface {
 	GetSize() (int64, error)
 }
 
+type Kind int
+
+const (
+	Absent Kind = iota
+	Regular
+	Directory
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Regular:
+		return "file"
+	case Directory:
+		return "dir"
+	default:
+		return "absent"
+	}
+}
+
+type DirEntry struct {
+	Name string
+	Kind Kind
+}
+
+func DirEntries(children map[string]Kind) []DirEntry {
+	list := make([]DirEntry, 0, len(children))
+	for name, kind := range children {
+		list = append(list, DirEntry{name, kind})
+	}
+	slices.SortFunc(list, func(a, b DirEntry) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
 func Store(tree Tree, e Entry) (Entry, error) {
 	data, err := e.GetData()
 	if err != nil {
@@ -25,3 +90,59 @@ func Store(tree Tree, e Entry) (Entry, error) {
 	}
 	return tree.Store(e.GetPath(), data)
 }
+
+// Sorted yields the entries ordered by path.
+func Sorted(entries iter.Seq2[string, Entry]) iter.Seq2[string, Entry] {
+	return func(yield func(string, Entry) bool) {
+		type match struct {
+			path string
+			e    Entry
+		}
+		var list []match
+		for p, e := range entries {
+			list = append(list, match{p, e})
+		}
+		slices.SortFunc(list, func(a, b match) int {
+			return strings.Compare(a.path, b.path)
+		})
+		for _, m := range list {
+			if !yield(m.path, m.e) {
+				return
+			}
+		}
+	}
+}
+
+func FindSorted(t Tree, path string) iter.Seq2[string, Entry] {
+	return Sorted(t.Find(path))
+}
+
+// CheckRename tells if old can be renamed to new by the rules of Tree, the
+// paths being normalized and new a valid one.
+func CheckRename(t Tree, old, new string) error {
+	kind, err := t.Stat(old)
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case Absent:
+		return os.ErrNotExist
+	case Directory:
+		if _, ok := Base(new, old); ok && (old == "" || len(new) == len(old) || new[len(old)] == '/') {
+			return os.ErrInvalid
+		}
+	}
+	for dir, _ := Split(new); dir != ""; dir, _ = Split(dir) {
+		if kind, err := t.Stat(dir); err != nil {
+			return err
+		} else if kind == Regular {
+			return os.ErrExist
+		}
+	}
+	if target, err := t.Stat(new); err != nil {
+		return err
+	} else if target == Directory || target == Regular && kind == Directory {
+		return os.ErrExist
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package file_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"packman/file"
+	"packman/file/filetest"
+	"packman/file/mem"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLocalConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		dir := t.TempDir()
+		for p, data := range files {
+			p = filepath.Join(dir, p)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0770))
+			require.NoError(t, os.WriteFile(p, []byte(data), 0660))
+		}
+		tree, err := file.LocalTree(dir)
+		require.NoError(t, err)
+		return tree
+	})
+}
+
+func TestFSConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		fsys := fstest.MapFS{}
+		for p, data := range files {
+			fsys[p] = &fstest.MapFile{Data: []byte(data)}
+		}
+		return file.FSTree(fsys)
+	})
+}
+
+func TestReadOnlyConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		s := make(mem.Store)
+		for p, data := range files {
+			_, err := s.Store(p, []byte(data))
+			require.NoError(t, err)
+		}
+		return file.ReadOnly(&s)
+	})
+}
@@ -0,0 +1,114 @@
+package file
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+type PathError struct {
+	Path   string
+	Reason string
+	Err    error // wrapped instead of os.ErrInvalid if set, see PathRules.Err
+}
+
+func (e *PathError) Error() string {
+	return fmt.Sprintf("invalid path %q: %s", e.Path, e.Reason)
+}
+
+func (e *PathError) Unwrap() error {
+	if e.Err != nil {
+		return e.Err
+	}
+	return os.ErrInvalid
+}
+
+// PathRules describe the paths a tree format can hold. Every tree rejects
+// invalid UTF-8, NUL bytes and paths leaving the root, the rules add to that.
+type PathRules struct {
+	// Illegal lists the characters a name can't contain.
+	Illegal string
+	// Control rejects the characters below U+0020.
+	Control bool
+	// Reserved lists names that can't be used, compared case-insensitively
+	// with the extension cut off.
+	Reserved []string
+	// MaxName and MaxPath limit the length in bytes, 0 means no limit.
+	MaxName int
+	MaxPath int
+	// Err is wrapped by the errors of the rules, it must wrap os.ErrInvalid.
+	Err error
+}
+
+var DefaultRules PathRules
+
+// Normalize cleans the path, composes it to NFC and checks it against the
+// rules. It returns "" for the root.
+func (r PathRules) Normalize(path string) (string, error) {
+	fail := func(reason string, a ...any) (string, error) {
+		return "", &PathError{path, fmt.Sprintf(reason, a...), r.Err}
+	}
+	if !utf8.ValidString(path) {
+		return fail("not UTF-8")
+	}
+	if strings.IndexByte(path, 0) >= 0 {
+		return fail("contains NUL")
+	}
+	p := Key(ToSlash(path))
+	if p == ".." || strings.HasPrefix(p, "../") {
+		return fail("outside of the root")
+	}
+	if r.MaxPath != 0 && len(p) > r.MaxPath {
+		return fail("longer than %d bytes", r.MaxPath)
+	}
+	for name := range strings.SplitSeq(p, "/") {
+		if r.MaxName != 0 && len(name) > r.MaxName {
+			return fail("name longer than %d bytes", r.MaxName)
+		}
+		if i := strings.IndexAny(name, r.Illegal); i >= 0 {
+			c, _ := utf8.DecodeRuneInString(name[i:])
+			return fail("illegal character %q", c)
+		}
+		if r.Control && strings.ContainsFunc(name, func(c rune) bool { return c < ' ' }) {
+			return fail("control character")
+		}
+		base, _, _ := strings.Cut(name, ".")
+		for _, n := range r.Reserved {
+			if strings.EqualFold(base, n) {
+				return fail("reserved name %s", name)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Key returns the normalized NFC form of a path, the form trees store and
+// look up paths in.
+func Key(path string) string {
+	return Norm(norm.NFC.String(path))
+}
+
+// Validator is implemented by trees with rules of their own.
+type Validator interface {
+	Rules() PathRules
+}
+
+func Rules(t Tree) PathRules {
+	if v, ok := t.(Validator); ok {
+		return v.Rules()
+	}
+	return DefaultRules
+}
+
+// ValidPath normalizes a path to be written to the tree, which must not be
+// the root.
+func ValidPath(t Tree, path string) (string, error) {
+	r := Rules(t)
+	p, err := r.Normalize(path)
+	if err == nil && p == "" {
+		err = &PathError{path, "the root", r.Err}
+	}
+	return p, err
+}
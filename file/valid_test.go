@@ -0,0 +1,43 @@
+package file
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	rules := PathRules{Illegal: `"`, Control: true, Reserved: []string{"CON"}, MaxName: 8, MaxPath: 16}
+	for path, exp := range map[string]string{
+		"":                  "",
+		"/a//b/":            "a/b",
+		`a\b`:               "a/b",
+		"a/../b":            "b",
+		"Cafe\u0301":        "Caf\u00e9",
+		"U\u0308\u0304.txt": "\u01d5.txt",
+		"\u1100\u1161":      "\uac00",
+		"\u03b1\u0301":      "\u03ac",
+		"a\u0302\u0323":     "\u1ead",
+		"con1.txt":          "con1.txt",
+	} {
+		p, err := rules.Normalize(path)
+		require.NoError(t, err, path)
+		require.Equal(t, exp, p, path)
+	}
+	for path, reason := range map[string]string{
+		"a\x00b":                "contains NUL",
+		"\xff":                  "not UTF-8",
+		"..":                    "outside of the root",
+		"a/../../b":             "outside of the root",
+		`a"b`:                   `illegal character '"'`,
+		"a\tb":                  "control character",
+		"dir/con.txt":           "reserved name con.txt",
+		"name12345":             "name longer than 8 bytes",
+		strings.Repeat("a/", 9): "longer than 16 bytes",
+	} {
+		_, err := rules.Normalize(path)
+		require.ErrorIs(t, err, os.ErrInvalid, path)
+		require.ErrorContains(t, err, reason, path)
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"io/fs"
 	"iter"
 	"os"
 	"packman/file"
+	"slices"
 	"strings"
+	"time"
 )
 
 var (
@@ -22,7 +25,7 @@ var (
 	ErrInvalidDataSec = errors.New("data size mismatch")
 	ErrInvalidMd5Sec  = errors.New("checksum section size mismatch")
 	ErrFileCorrupted  = errors.New("file corrupted")
-	ErrInvalidPath    = errors.New("invalid path")
+	ErrInvalidPath    = fmt.Errorf("invalid path: %w", os.ErrInvalid)
 )
 
 type Tree []Ext
@@ -281,6 +284,21 @@ func buildPath(dir, name, ext string) string {
 	return fmt.Sprintf("%s/%s.%s", dir, name, ext)
 }
 
+func (e *Entry) GetModTime() (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (e *Entry) GetMode() (fs.FileMode, error) {
+	return 0, nil
+}
+
+func (e *Entry) GetHash() (uint32, error) {
+	if e.crc == 0 {
+		e.crc = crc32.ChecksumIEEE(e.data)
+	}
+	return e.crc, nil
+}
+
 func (e Entry) String() string {
 	return e.GetPath()
 }
@@ -326,32 +344,19 @@ func splitExt(path string) (file string, ext string) {
 }
 
 func cleanPath(path string) string {
-	if path = file.Clean(path); path == "" {
-		return ""
-	}
-	if path[0] == '/' {
-		if path = path[1:]; path == "" {
-			return ""
-		}
-	}
-	if end := len(path) - 1; path[end] == '/' {
-		if path = path[:end]; path == "" {
-			return ""
-		}
-	}
-	if path == "." {
-		return ""
-	}
-	return path
+	return file.Key(path)
 }
 
-func (t *Tree) Get(path string) (file.Entry, error) {
-	path = cleanPath(path)
-	dir, f := file.Split(path)
-	if dir == "" {
+func splitPath(path string) (dir, name, ext string) {
+	if dir, name = file.Split(path); dir == "" {
 		dir = " "
 	}
-	name, ename := splitExt(f)
+	name, ext = splitExt(name)
+	return
+}
+
+func (t *Tree) lookup(path string) (*Entry, bool) {
+	dir, name, ename := splitPath(path)
 	for _, ext := range *t {
 		if ext.Name != ename {
 			continue
@@ -362,11 +367,24 @@ func (t *Tree) Get(path string) (file.Entry, error) {
 			}
 			for _, e := range p.Entries {
 				if e.Name == name {
-					return &Entry{ename, dir, e}, nil
+					return &Entry{ename, dir, e}, true
 				}
 			}
 		}
 	}
+	return nil, false
+}
+
+func (t *Tree) Get(path string) (file.Entry, error) {
+	if path = cleanPath(path); path == "" {
+		return nil, os.ErrInvalid
+	}
+	if e, ok := t.lookup(path); ok {
+		return e, nil
+	}
+	if kind, _ := t.Stat(path); kind == file.Directory {
+		return nil, os.ErrInvalid
+	}
 	return nil, os.ErrNotExist
 }
 
@@ -382,6 +400,10 @@ func (t *Tree) Find(path string) iter.Seq2[string, file.Entry] {
 	}
 
 	return func(yield func(string, file.Entry) bool) {
+		if e, ok := t.lookup(path); ok {
+			yield(".", e)
+			return
+		}
 		for _, ext := range *t {
 			for _, dir := range ext.Dirs {
 				if dir.Path == path {
@@ -402,23 +424,63 @@ func (t *Tree) Find(path string) iter.Seq2[string, file.Entry] {
 							return
 						}
 					}
-					continue
 				}
-				if strings.HasPrefix(path, dir.Path) && path[len(dir.Path)] == '/' {
-					f := path[len(dir.Path)+1:]
-					name, ename := splitExt(f)
-					if ext.Name != ename {
-						continue
-					}
-					for _, e := range dir.Entries {
-						if e.Name == name && !yield(".", &Entry{ext.Name, dir.Path, e}) {
-							return
-						}
-					}
+			}
+		}
+	}
+}
+
+func (t *Tree) Stat(path string) (file.Kind, error) {
+	if path = cleanPath(path); path == "" {
+		return file.Directory, nil
+	}
+	if _, ok := t.lookup(path); ok {
+		return file.Regular, nil
+	}
+	for _, ext := range *t {
+		for _, dir := range ext.Dirs {
+			if dir.Path == path || strings.HasPrefix(dir.Path, path) && dir.Path[len(path)] == '/' {
+				return file.Directory, nil
+			}
+		}
+	}
+	return file.Absent, nil
+}
+
+func (t *Tree) ReadDir(path string) ([]file.DirEntry, error) {
+	path = cleanPath(path)
+	if path != "" {
+		if _, ok := t.lookup(path); ok {
+			return nil, os.ErrInvalid
+		}
+	}
+	children := make(map[string]file.Kind)
+	for _, ext := range *t {
+		for _, dir := range ext.Dirs {
+			p := dir.Path
+			if p == " " {
+				p = ""
+			}
+			if p == path {
+				for _, e := range dir.Entries {
+					children[buildName(e.Name, ext.Name)] = file.Regular
 				}
+				continue
+			}
+			rel, ok := file.Base(p, path)
+			if !ok || path != "" && p[len(path)] != '/' {
+				continue
 			}
+			if i := strings.IndexByte(rel, '/'); i >= 0 {
+				rel = rel[:i]
+			}
+			children[rel] = file.Directory
 		}
 	}
+	if len(children) == 0 && path != "" {
+		return nil, os.ErrNotExist
+	}
+	return file.DirEntries(children), nil
 }
 
 func (t *Tree) Remove(path string, ln func(path string)) error {
@@ -443,6 +505,7 @@ func (t *Tree) Remove(path string, ln func(path string)) error {
 		return nil
 	}
 
+	fdir, fname, fext := splitPath(path)
 	u := (*t)[:0]
 	var removed []string
 	for _, ext := range *t {
@@ -457,25 +520,21 @@ func (t *Tree) Remove(path string, ln func(path string)) error {
 				}
 				continue
 			}
-			if strings.HasPrefix(path, dir.Path) && path[len(dir.Path)] == '/' {
-				f := path[len(dir.Path)+1:]
-				name, ename := splitExt(f)
-				if ext.Name == ename {
-					entries := dir.Entries[:0]
-					for _, e := range dir.Entries {
-						if e.Name == name {
-							if ln != nil {
-								removed = append(removed, path)
-							}
-							continue
+			if dir.Path == fdir && ext.Name == fext {
+				entries := dir.Entries[:0]
+				for _, e := range dir.Entries {
+					if e.Name == fname {
+						if ln != nil {
+							removed = append(removed, path)
 						}
-						entries = append(entries, e)
-					}
-					if len(entries) == 0 {
 						continue
 					}
-					dir.Entries = entries
+					entries = append(entries, e)
+				}
+				if len(entries) == 0 {
+					continue
 				}
+				dir.Entries = entries
 			}
 			dirs = append(dirs, dir)
 		}
@@ -494,21 +553,77 @@ func (t *Tree) Remove(path string, ln func(path string)) error {
 	return nil
 }
 
-func (t *Tree) Store(path string, data []byte) (file.Entry, error) {
-	path = file.Clean(path)
-	var name string
-	if path, name = file.Split(path); name == "" {
-		return nil, ErrInvalidPath
+func (t *Tree) Rename(old, new string) error {
+	if old = cleanPath(old); old == "" {
+		return os.ErrInvalid
+	}
+	new, err := file.ValidPath(t, new)
+	if err != nil {
+		return err
+	}
+	if old == new {
+		return nil
+	}
+	if err := file.CheckRename(t, old, new); err != nil {
+		return err
+	}
+	if f, ok := t.lookup(old); ok {
+		dir, name, ext := splitPath(new)
+		t.put(ext, dir, name, f.data, f.crc)
+		t.unlink(f.Ext, f.Path, f.Name)
+		return nil
 	}
-	if path == "" {
-		path = " "
+	type move struct {
+		path string
+		e    *Entry
 	}
-	name, ext := splitExt(name)
-	entry := t.put(ext, path, name, data)
+	var moved []move
+	for p, e := range t.Find(old) {
+		moved = append(moved, move{file.Join(new, p), e.(*Entry)})
+	}
+	for _, m := range moved {
+		dir, name, ext := splitPath(m.path)
+		t.put(ext, dir, name, m.e.data, m.e.crc)
+	}
+	return t.Remove(old, nil)
+}
+
+func (t *Tree) unlink(ext, path, name string) {
+	for i := range *t {
+		x := &(*t)[i]
+		if x.Name != ext {
+			continue
+		}
+		for j := range x.Dirs {
+			d := &x.Dirs[j]
+			if d.Path != path {
+				continue
+			}
+			d.Entries = slices.DeleteFunc(d.Entries, func(f File) bool {
+				return f.Name == name
+			})
+			if len(d.Entries) == 0 {
+				x.Dirs = slices.Delete(x.Dirs, j, j+1)
+			}
+			if len(x.Dirs) == 0 {
+				*t = slices.Delete(*t, i, i+1)
+			}
+			return
+		}
+	}
+}
+
+func (t *Tree) Store(path string, data []byte) (file.Entry, error) {
+	path, err := file.ValidPath(t, path)
+	if err != nil {
+		return nil, err
+	}
+	dir, name, ext := splitPath(path)
+	entry := t.put(ext, dir, name, data, 0)
 	return &entry, nil
 }
 
-func (t *Tree) put(ext, path, file string, data []byte) Entry {
+func (t *Tree) put(ext, path, file string, data []byte, crc uint32) Entry {
 	var e *Ext
 	for i := range *t {
 		if ex := &(*t)[i]; ex.Name == ext {
@@ -534,21 +649,44 @@ func (t *Tree) put(ext, path, file string, data []byte) Entry {
 		dir = &e.Dirs[n]
 	}
 
-	for _, f := range dir.Entries {
-		if f.Name == file {
-			f.SetData(data)
-			return Entry{ext, path, f}
+	for i := range dir.Entries {
+		if f := &dir.Entries[i]; f.Name == file {
+			f.data, f.crc = data, crc
+			return Entry{ext, path, *f}
 		}
 	}
 
-	entry := Entry{ext, path, File{file, data, 0}}
+	entry := Entry{ext, path, File{file, data, crc}}
 	dir.Entries = append(dir.Entries, entry.File)
 	return entry
 }
 
+// Rules keep names free of the quote splitExt treats specially and of the
+// " " standing for an empty string, the names are stored NUL-terminated and
+// the engine reads them into MAX_PATH buffers.
+func (t *Tree) Rules() file.PathRules {
+	return file.PathRules{
+		Illegal:  `"`,
+		Control:  true,
+		Reserved: []string{" "},
+		MaxPath:  259,
+		Err:      ErrInvalidPath,
+	}
+}
+
 func (t *Tree) Put(e file.Entry) (file.Entry, error) {
-	if te, ok := e.(*Entry); ok {
-		t.put(te.Ext, te.Path, te.Name, te.data)
+	switch te := e.(type) {
+	case *Entry:
+		entry := t.put(te.Ext, te.Path, te.Name, te.data, te.crc)
+		return &entry, nil
+	case *file.Loaded:
+		path, err := file.ValidPath(t, te.Path)
+		if err != nil {
+			return nil, err
+		}
+		dir, name, ext := splitPath(path)
+		entry := t.put(ext, dir, name, te.Data, te.CRC)
+		return &entry, nil
 	}
 	data, err := e.GetData()
 	if err != nil {
@@ -4,7 +4,11 @@ import (
 	_ "embed"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
 	"maps"
+	"os"
+	"packman/file"
+	"packman/file/filetest"
 	"slices"
 	"strings"
 	"testing"
@@ -140,6 +144,93 @@ func TestLookup(t *testing.T) {
 	require.Equal(t, []string{"."}, file111)
 }
 
+func TestStatReadDir(t *testing.T) {
+	s, err := Parse(localVpk)
+	require.NoError(t, err)
+
+	kind, err := s.Stat("dir1")
+	require.NoError(t, err)
+	require.Equal(t, file.Directory, kind)
+
+	kind, err = s.Stat("dir1/file11.txt")
+	require.NoError(t, err)
+	require.Equal(t, file.Regular, kind)
+
+	kind, err = s.Stat("dir")
+	require.NoError(t, err)
+	require.Equal(t, file.Absent, kind)
+
+	list, err := s.ReadDir("")
+	require.NoError(t, err)
+	require.Equal(t, "dir1/ dir2/ file01.txt file02.md", dirNames(list))
+
+	list, err = s.ReadDir("dir1/")
+	require.NoError(t, err)
+	require.Equal(t, "dir11/ dir12/ file11.txt file12.txt", dirNames(list))
+
+	_, err = s.ReadDir("dir3")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRename(t *testing.T) {
+	tree, err := Parse(localVpk)
+	require.NoError(t, err)
+
+	require.NoError(t, tree.Rename("dir1/file11.txt", "file11.md"))
+	e, err := tree.Get("file11.md")
+	require.NoError(t, err)
+	data, err := e.GetData()
+	require.NoError(t, err)
+	require.Equal(t, "file11", string(data))
+
+	require.NoError(t, tree.Rename("dir1", "dir2/dir1"))
+	dir2 := slices.Collect(maps.Keys(maps.Collect(tree.Find("dir2"))))
+	slices.Sort(dir2)
+	require.Equal(t, "dir1/dir11/file111.md dir1/dir12/file121.txt dir1/file12.txt file22.txt", strings.Join(dir2, " "))
+	require.Equal(t, "file01 file02 file11 file111 file12 file121 file22", readAll(tree))
+
+	require.ErrorIs(t, tree.Rename("dir1", "dir5"), os.ErrNotExist)
+}
+
+func TestHash(t *testing.T) {
+	tree, err := Parse(localVpk)
+	require.NoError(t, err)
+
+	e, err := tree.Get("dir1/file11.txt")
+	require.NoError(t, err)
+	h, err := file.Hash(e)
+	require.NoError(t, err)
+	require.Equal(t, crc32.ChecksumIEEE([]byte("file11")), h)
+	require.Equal(t, h, e.(*Entry).crc)
+}
+
+func TestConformance(t *testing.T) {
+	filetest.TestTree(t, func(t *testing.T, files map[string]string) file.Tree {
+		s := &Tree{}
+		for p, data := range files {
+			_, err := s.Store(p, []byte(data))
+			require.NoError(t, err)
+		}
+		return s
+	})
+}
+
+func TestInvalidPath(t *testing.T) {
+	var tree Tree
+	for _, p := range []string{`dir/name"`, "dir/a\nb", " /file", "dir/ .txt", strings.Repeat("a", 260)} {
+		_, err := tree.Store(p, nil)
+		require.ErrorIs(t, err, os.ErrInvalid, p)
+		require.ErrorIs(t, err, ErrInvalidPath, p)
+		var pe *file.PathError
+		require.ErrorAs(t, err, &pe, p)
+	}
+	require.Empty(t, tree)
+	require.ErrorIs(t, tree.Rename("a", ""), ErrInvalidPath)
+
+	_, err := tree.Store("dir/"+strings.Repeat("a", 255), nil)
+	require.NoError(t, err)
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 // Supplementary classes & routines                                                                               //
 ////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -152,3 +243,13 @@ func readAll(tree Tree) string {
 	slices.Sort(data)
 	return strings.Join(data, " ")
 }
+
+func dirNames(list []file.DirEntry) string {
+	names := make([]string, len(list))
+	for i, e := range list {
+		if names[i] = e.Name; e.Kind == file.Directory {
+			names[i] += "/"
+		}
+	}
+	return strings.Join(names, " ")
+}
@@ -0,0 +1,21 @@
+package file
+
+// Watcher is implemented by trees that can report changes. Watch sends the
+// path of every changed file or directory until done is closed, the channel
+// is closed afterwards.
+type Watcher interface {
+	Watch(done <-chan struct{}) (<-chan string, error)
+}
+
+func (l local) Watch(done <-chan struct{}) (<-chan string, error) {
+	return l.watch(done)
+}
+
+func (l local) notify(ch chan<- string, done <-chan struct{}, path string) bool {
+	select {
+	case ch <- path:
+		return true
+	case <-done:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+type inotify struct {
+	local
+	fd   int
+	dirs map[int32]string
+}
+
+func (l local) watch(done <-chan struct{}) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &inotify{l, fd, make(map[int32]string)}
+	// a non-blocking descriptor goes to the runtime poller, so Close
+	// interrupts a pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	if err := w.add(l.root); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	ch := make(chan string, 64)
+	go func() {
+		<-done
+		_ = f.Close()
+	}()
+	go func() {
+		defer close(ch)
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				return
+			}
+			for ev := buf[:n]; len(ev) >= syscall.SizeofInotifyEvent; {
+				wd := int32(binary.NativeEndian.Uint32(ev))
+				mask := binary.NativeEndian.Uint32(ev[4:])
+				size := int(binary.NativeEndian.Uint32(ev[12:]))
+				name := ev[syscall.SizeofInotifyEvent : syscall.SizeofInotifyEvent+size]
+				ev = ev[syscall.SizeofInotifyEvent+size:]
+				if i := bytes.IndexByte(name, 0); i >= 0 {
+					name = name[:i]
+				}
+				dir, ok := w.dirs[wd]
+				if !ok {
+					continue
+				}
+				if mask&syscall.IN_IGNORED != 0 {
+					delete(w.dirs, wd)
+					continue
+				}
+				path := filepath.Join(dir, string(name))
+				if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					_ = w.add(path)
+				}
+				if !l.notify(ch, done, w.rel(path)) {
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (w *inotify) add(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p != dir && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
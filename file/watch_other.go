@@ -0,0 +1,68 @@
+//go:build !linux
+
+package file
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const pollInterval = time.Second
+
+type stamp struct {
+	size  int64
+	mtime time.Time
+}
+
+func (l local) watch(done <-chan struct{}) (<-chan string, error) {
+	if _, err := os.Stat(l.root); err != nil {
+		return nil, err
+	}
+	ch := make(chan string, 64)
+	go func() {
+		defer close(ch)
+		last := l.scan()
+		t := time.NewTicker(pollInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			next := l.scan()
+			for p, s := range next {
+				if o, ok := last[p]; !ok || o != s {
+					if !l.notify(ch, done, p) {
+						return
+					}
+				}
+			}
+			for p := range last {
+				if _, ok := next[p]; !ok {
+					if !l.notify(ch, done, p) {
+						return
+					}
+				}
+			}
+			last = next
+		}
+	}()
+	return ch, nil
+}
+
+func (l local) scan() map[string]stamp {
+	files := make(map[string]stamp)
+	_ = filepath.WalkDir(l.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if s, err := d.Info(); err == nil {
+			files[l.rel(p)] = stamp{s.Size(), s.ModTime()}
+		}
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,46 @@
+package file
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	loc, err := LocalTree("test/tmp")
+	require.NoError(t, err)
+	done := make(chan struct{})
+	ch, err := loc.(Watcher).Watch(done)
+	require.NoError(t, err)
+
+	await := func(path string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case p := <-ch:
+				if p == path {
+					return
+				}
+			case <-timeout:
+				require.Fail(t, "no event", path)
+			}
+		}
+	}
+
+	require.NoError(t, os.WriteFile("test/tmp/f1.txt", []byte("f1"), 0660))
+	await("f1.txt")
+	require.NoError(t, os.Mkdir("test/tmp/dir", 0770))
+	await("dir")
+	require.NoError(t, os.WriteFile("test/tmp/dir/f2.txt", []byte("f2"), 0660))
+	await("dir/f2.txt")
+	require.NoError(t, os.Remove("test/tmp/f1.txt"))
+	await("f1.txt")
+
+	close(done)
+	for range ch {
+	}
+}
@@ -0,0 +1,95 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the file atomically. The data goes to a temporary file in
+// the same directory which is synced and then renamed over the path, so an
+// interrupted write leaves either the old or the new content. An existing
+// file keeps its permissions and a link keeps pointing to the replaced file.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return WriteFileFrom(path, bytes.NewReader(data), perm)
+}
+
+// WriteFileFrom replaces the file atomically like WriteFile with the content
+// src writes, so it needn't be held in memory.
+func WriteFileFrom(path string, src io.WriterTo, perm os.FileMode) (err error) {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	if s, err := os.Stat(path); err == nil {
+		perm = s.Mode().Perm()
+	}
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if _, err = src.WriteTo(w); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Backup keeps the current content of the file as path.bak and returns the
+// backup path, or "" if there is no file yet.
+func Backup(path string) (string, error) {
+	bak := path + ".bak"
+	if err := os.Remove(bak); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Link(path, bak); err == nil {
+		return bak, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
+	if err := WriteFile(bak, data, 0660); err != nil {
+		return "", err
+	}
+	return bak, nil
+}
+
+func syncDir(dir string) {
+	// not every platform can sync a directory, the rename is done anyway
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package file
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	require.NoError(t, WriteFile("test/tmp/f1.txt", []byte("f1"), 0640))
+	require.Equal(t, "f1", readFile("test/tmp/f1.txt"))
+	s, err := os.Stat("test/tmp/f1.txt")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0640), s.Mode().Perm())
+
+	require.NoError(t, os.Symlink("f1.txt", "test/tmp/link"))
+	require.NoError(t, WriteFile("test/tmp/link", []byte("f1+"), 0660))
+	require.Equal(t, "f1+", readFile("test/tmp/f1.txt"))
+	s, err = os.Lstat("test/tmp/link")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSymlink, s.Mode().Type())
+
+	bak, err := Backup("test/tmp/f1.txt")
+	require.NoError(t, err)
+	require.Equal(t, "test/tmp/f1.txt.bak", bak)
+	require.NoError(t, WriteFile("test/tmp/f1.txt", []byte("f2"), 0660))
+	require.Equal(t, "f1+", readFile(bak))
+
+	bak, err = Backup("test/tmp/f2.txt")
+	require.NoError(t, err)
+	require.Equal(t, "", bak)
+
+	entries, err := os.ReadDir("test/tmp")
+	require.NoError(t, err)
+	require.Equal(t, 3, len(entries))
+}
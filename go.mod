@@ -1,8 +1,11 @@
 module packman
 
-go 1.24
+go 1.24.0
 
-require github.com/stretchr/testify v1.8.4
+require (
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/text v0.34.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
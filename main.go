@@ -1,13 +1,23 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"os"
 	"packman/file"
+	"packman/file/mem"
 	"packman/file/vpk"
 	"packman/script"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 )
 
 var version = "dev"
@@ -15,19 +25,22 @@ var version = "dev"
 func main() {
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
-		case "run":
-			if len(os.Args) != 3 {
+		case "run", "watch":
+			opts, path, ok := runOptions(os.Args[2:])
+			if !ok {
 				break
 			}
-			src, err := os.ReadFile(os.Args[2])
-			if err != nil {
-				log.Fatal(err)
+			if os.Args[1] == "watch" {
+				if err := watch(path, opts); err != nil {
+					log.Fatal(err)
+				}
+				return
 			}
-			s, err := script.Parse(src)
+			s, err := script.ParseFile(path)
 			if err != nil {
 				log.Fatal(err)
 			}
-			if err = s.Run(log.Printf); err != nil {
+			if err = s.Exec(opts); err != nil {
 				log.Fatal(err)
 			}
 			return
@@ -35,20 +48,11 @@ func main() {
 			if len(os.Args) != 3 {
 				break
 			}
-			s, err := os.Stat(os.Args[2])
-			if err != nil {
-				log.Fatal(err)
-			}
-			var tree file.Tree
-			if s.IsDir() {
-				tree, err = file.LocalTree(os.Args[2])
-			} else {
-				tree, err = vpk.Read(os.Args[2])
-			}
+			tree, err := open(os.Args[2])
 			if err != nil {
 				log.Fatal(err)
 			}
-			for f, e := range tree.Find("") {
+			for f, e := range file.FindSorted(tree, "") {
 				if sz, err := e.GetSize(); err == nil {
 					fmt.Println(f, sz)
 				} else {
@@ -56,6 +60,46 @@ func main() {
 				}
 			}
 			return
+		case "diff":
+			args := os.Args[2:]
+			asJSON := len(args) != 0 && args[0] == "-json"
+			if asJSON {
+				args = args[1:]
+			}
+			if len(args) != 2 {
+				break
+			}
+			if err := diff(args[0], args[1], asJSON); err != nil {
+				log.Fatal(err)
+			}
+			return
+		case "stats":
+			args := os.Args[2:]
+			asJSON, top := false, 10
+		flags:
+			for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+				switch {
+				case args[0] == "-json":
+					asJSON = true
+				case args[0] == "-n" && len(args) > 2:
+					n, err := strconv.Atoi(args[1])
+					if err != nil || n < 0 {
+						log.Fatalf("invalid number of files %s", args[1])
+					}
+					top = n
+					args = args[1:]
+				default:
+					break flags
+				}
+				args = args[1:]
+			}
+			if len(args) != 1 {
+				break
+			}
+			if err := stats(args[0], top, asJSON); err != nil {
+				log.Fatal(err)
+			}
+			return
 		case "ver", "version":
 			if len(os.Args) != 2 {
 				break
@@ -72,8 +116,223 @@ func main() {
 	fmt.Println()
 	fmt.Println("The commands and their arguments:")
 	fmt.Println()
-	fmt.Println("    run  <path>     run the script")
-	fmt.Println("    list <path>     read file tree")
-	fmt.Println("    version         print app version")
+	fmt.Println("    run  [-b] [-m size] [-j N] <path> [name=value ...]")
+	fmt.Println("                      run the script, -b keeps .bak copies of replaced")
+	fmt.Println("                      archives until all of them are written, -m keeps")
+	fmt.Println("                      in-memory bindings within size and the rest on disk,")
+	fmt.Println("                      -j sets the default number of copy workers,")
+	fmt.Println("                      the name=value pairs set script variables")
+	fmt.Println("    watch [-b] [-m size] [-j N] <path> [name=value ...]")
+	fmt.Println("                      run the script like run and re-run it on changes")
+	fmt.Println("                      of the directories it reads from")
+	fmt.Println("    list <path>       read file tree")
+	fmt.Println("    diff [-json] <a> <b>")
+	fmt.Println("                      list files added, removed or modified in b")
+	fmt.Println("    stats [-json] [-n N] <path>")
+	fmt.Println("                      sum up sizes by extension and top-level")
+	fmt.Println("                      directory and list the N largest files")
+	fmt.Println("    version           print app version")
 	os.Exit(1)
 }
+
+// runOptions reads the flags and parameters of run and watch.
+func runOptions(args []string) (opts script.Options, path string, ok bool) {
+	opts.Log = log.Printf
+	for len(args) > 1 && strings.HasPrefix(args[0], "-") {
+		switch {
+		case args[0] == "-b":
+			opts.Backup = true
+		case args[0] == "-m" && len(args) > 2:
+			budget, ok := script.ParseSize(args[1])
+			if !ok {
+				log.Fatalf("invalid size %s", args[1])
+			}
+			opts.MemBudget = budget
+			args = args[1:]
+		case args[0] == "-j" && len(args) > 2:
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("invalid number of jobs %s", args[1])
+			}
+			opts.Jobs = n
+			args = args[1:]
+		default:
+			return opts, "", false
+		}
+		args = args[1:]
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return opts, "", false
+	}
+	for _, a := range args[1:] {
+		name, value, ok := strings.Cut(a, "=")
+		if !ok {
+			log.Fatalf("invalid parameter %s, expected name=value", a)
+		}
+		if !script.ValidName(name) {
+			log.Fatalf("invalid parameter name %q", name)
+		}
+		if opts.Vars == nil {
+			opts.Vars = make(map[string]string)
+		}
+		opts.Vars[name] = value
+	}
+	return opts, args[0], true
+}
+
+func open(path string) (file.Tree, error) {
+	s, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.IsDir() {
+		return file.LocalTree(path)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".pms") {
+		return mem.Read(path)
+	}
+	return vpk.Read(path)
+}
+
+func diff(a, b string, asJSON bool) error {
+	old, err := open(a)
+	if err != nil {
+		return err
+	}
+	cur, err := open(b)
+	if err != nil {
+		return err
+	}
+	list, err := file.Diff(old, cur)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if list == nil {
+			list = []file.Delta{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	for _, d := range list {
+		fmt.Printf("%-8s %s\n", d.Change, d.Path)
+	}
+	return nil
+}
+
+func stats(path string, top int, asJSON bool) error {
+	tree, err := open(path)
+	if err != nil {
+		return err
+	}
+	s, err := file.Summarize(tree, top)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(s)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "total\t%d files\t%d bytes\n", s.Files, s.Bytes)
+	groups := func(title, none string, list []file.Group) {
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, g := range list {
+			if g.Name == "" {
+				g.Name = none
+			}
+			fmt.Fprintf(w, "  %s\t%d files\t%d bytes\n", g.Name, g.Files, g.Bytes)
+		}
+	}
+	groups("by extension", "-", s.Exts)
+	groups("by directory", ".", s.Dirs)
+	if len(s.Largest) != 0 {
+		fmt.Fprintf(w, "\nlargest:\n")
+		for _, f := range s.Largest {
+			fmt.Fprintf(w, "  %s\t%d bytes\n", f.Path, f.Bytes)
+		}
+	}
+	return w.Flush()
+}
+
+const debounce = 300 * time.Millisecond
+
+func watch(path string, opts script.Options) error {
+	s, err := script.ParseFile(path)
+	if err != nil {
+		return err
+	}
+	dirs, err := s.Sources(opts.Vars)
+	if err != nil {
+		return err
+	}
+	if len(dirs) == 0 {
+		return errors.New("the script reads from no local directory to watch")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	events := make(chan string)
+	var wg sync.WaitGroup
+	for _, dir := range dirs {
+		tree, err := file.LocalTree(dir)
+		if err != nil {
+			return err
+		}
+		ch, err := tree.(file.Watcher).Watch(done)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				events <- filepath.Join(dir, p)
+			}
+		}()
+		log.Printf("watching %s", dir)
+	}
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	run := func() {
+		start := time.Now()
+		if err := s.Exec(opts); err != nil {
+			log.Printf("build failed: %v", err)
+			return
+		}
+		log.Printf("build done in %v", time.Since(start).Round(time.Millisecond))
+	}
+	run()
+	for {
+		p, ok := <-events
+		if !ok {
+			return errors.New("watching stopped")
+		}
+		changed := map[string]bool{p: true}
+		for quiet := time.After(debounce); quiet != nil; {
+			select {
+			case p, ok := <-events:
+				if !ok {
+					quiet = nil
+					continue
+				}
+				changed[p] = true
+				quiet = time.After(debounce)
+			case <-quiet:
+				quiet = nil
+			}
+		}
+		list := slices.Sorted(maps.Keys(changed))
+		if len(list) == 1 {
+			log.Printf("changed %s", list[0])
+		} else {
+			log.Printf("changed %s and %d more", list[0], len(list)-1)
+		}
+		run()
+	}
+}
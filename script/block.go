@@ -0,0 +1,606 @@
+package script
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"os"
+	"packman/file"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type stmt struct {
+	no   int
+	elem []string
+}
+
+func errMissingEnd(lno int, cmd string) error {
+	return errorAt(lno, "missing end of %s", cmd)
+}
+
+type position struct {
+	file string
+	line int
+}
+
+type parser struct {
+	file  string // the included script, empty for the script itself
+	dir   string // includes are relative to
+	stack []string
+	pos   map[Command]position
+	defs  map[string]*def
+}
+
+func (p *parser) parse(src []byte) ([]Command, error) {
+	cmds, err := p.parseLines(src)
+	if err != nil {
+		if e := (*Error)(nil); errors.As(err, &e) {
+			if e.File == "" {
+				e.File = p.file
+			}
+		} else if p.file != "" {
+			err = fmt.Errorf("%s: %w", p.file, err)
+		}
+	}
+	return cmds, err
+}
+
+func (p *parser) parseLines(src []byte) ([]Command, error) {
+	if !utf8.Valid(src) {
+		return nil, ErrNonScript
+	}
+	var lp lineParser
+	var lines []stmt
+	lno := 0
+	for len(src) != 0 {
+		lno++
+		var line string
+		i := bytes.IndexByte(src, '\n')
+		if i < 0 {
+			line, src = string(src), src[len(src):]
+		} else {
+			line, src = string(src[:i]), src[i+1:]
+		}
+		line = strings.Trim(line, " \t\r")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		elem, err := lp.parse(lno, line)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, stmt{lno, elem})
+	}
+	cmds, lines, err := p.parseBlock(lines)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) != 0 {
+		return nil, errorAt(lines[0].no, "%s without if", lines[0].elem[0])
+	}
+	return cmds, nil
+}
+
+// parseBlock parses the commands up to an else or end, which starts the
+// returned lines, or up to the last line.
+func (p *parser) parseBlock(lines []stmt) (cmds []Command, rest []stmt, err error) {
+	for len(lines) != 0 {
+		l := lines[0]
+		var c Command
+		switch l.elem[0] {
+		case "else", "end":
+			return cmds, lines, nil
+		case "if":
+			c, lines, err = p.parseIf(lines)
+		case "foreach":
+			c, lines, err = p.parseForeach(lines)
+		case "def":
+			c, lines, err = p.parseDef(lines)
+		case "include":
+			var included []Command
+			if included, err = p.include(l); err != nil {
+				return nil, nil, err
+			}
+			cmds = append(cmds, included...)
+			lines = lines[1:]
+			continue
+		default:
+			c, err = parseLine(l.no, l.elem)
+			lines = lines[1:]
+			if c, ok := c.(*call); ok && err == nil {
+				err = p.checkCall(l.no, c)
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		p.pos[c] = position{p.file, l.no}
+		cmds = append(cmds, c)
+	}
+	return cmds, nil, nil
+}
+
+func (p *parser) include(l stmt) ([]Command, error) {
+	if len(l.elem) != 2 {
+		return nil, errIllegalArgCount(l.no, "include")
+	}
+	path := l.elem[1]
+	if strings.Contains(path, "${") {
+		return nil, errorAt(l.no, "variables can't be used in include")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, &Error{Line: l.no, Err: err}
+	}
+	if slices.Contains(p.stack, abs) {
+		return nil, errorAt(l.no, "include cycle through %s", path)
+	}
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, &Error{Line: l.no, Err: err}
+	}
+	sub := parser{path, filepath.Dir(path), append(slices.Clip(p.stack), abs), p.pos, p.defs}
+	return sub.parse(src)
+}
+
+func (p *parser) parseIf(lines []stmt) (Command, []stmt, error) {
+	l := lines[0]
+	cond, err := parseCond(l.no, l.elem[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &ifElse{cond: cond}
+	p.pos[c] = position{p.file, l.no}
+	if c.then, lines, err = p.parseBlock(lines[1:]); err != nil {
+		return nil, nil, err
+	}
+	if len(lines) == 0 {
+		return nil, nil, errMissingEnd(l.no, "if")
+	}
+	switch t := lines[0]; {
+	case t.elem[0] == "end":
+		if len(t.elem) != 1 {
+			return nil, nil, errIllegalArgCount(t.no, "end")
+		}
+		return c, lines[1:], nil
+	case len(t.elem) > 1 && t.elem[1] == "if":
+		lines[0].elem = t.elem[1:]
+		nested, lines, err := p.parseIf(lines)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.els = []Command{nested}
+		return c, lines, nil
+	case len(t.elem) != 1:
+		return nil, nil, errIllegalArgCount(t.no, "else")
+	}
+	if c.els, lines, err = p.parseBlock(lines[1:]); err != nil {
+		return nil, nil, err
+	}
+	lines, err = parseEnd(l.no, "if", lines)
+	return c, lines, err
+}
+
+// block is a command holding other commands.
+type block interface {
+	blocks() [][]Command
+}
+
+// each yields the commands and the commands nested in them.
+func each(cmds []Command) iter.Seq[Command] {
+	return func(yield func(Command) bool) {
+		var walk func(cmds []Command) bool
+		walk = func(cmds []Command) bool {
+			for _, c := range cmds {
+				if !yield(c) {
+					return false
+				}
+				if b, ok := c.(block); ok {
+					for _, cmds := range b.blocks() {
+						if !walk(cmds) {
+							return false
+						}
+					}
+				}
+			}
+			return true
+		}
+		walk(cmds)
+	}
+}
+
+// exec runs the commands, adding the position of the failed command to an
+// error without one.
+func (env env) exec(cmds []Command) error {
+	for _, c := range cmds {
+		env.log("%s", c)
+		if err := c.run(env); err != nil {
+			pos, ok := env.pos[c]
+			if e := (*Error)(nil); errors.As(err, &e) {
+				if e.File == "" {
+					e.File = pos.file
+				}
+			} else if ok {
+				err = &Error{pos.file, pos.line, err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+type cond struct {
+	lno  int
+	not  bool
+	op   string
+	args []string
+}
+
+// parseCond reads one of
+//
+//	[not] exists A:path
+//	[not] changed A:path B:path
+//	[not] defined name
+//	value == value
+//	value != value
+func parseCond(lno int, args []string) (*cond, error) {
+	c := &cond{lno: lno}
+	if len(args) != 0 && args[0] == "not" {
+		c.not, args = true, args[1:]
+	}
+	if len(args) == 3 && (args[1] == "==" || args[1] == "!=") && !c.not {
+		c.op, c.args = args[1], []string{args[0], args[2]}
+		return c, nil
+	}
+	if len(args) == 0 {
+		return nil, errIllegalArgCount(lno, "if")
+	}
+	c.op, c.args = args[0], args[1:]
+	n := 0
+	switch c.op {
+	case "exists", "defined":
+		n = 1
+	case "changed":
+		n = 2
+	default:
+		return nil, errorAt(lno, "unknown condition %s", shown(c.op))
+	}
+	if len(c.args) != n {
+		return nil, errIllegalArgCount(lno, "if")
+	}
+	for _, a := range c.args {
+		if strings.Contains(a, "${") {
+			continue
+		}
+		if c.op == "defined" && !patPack.MatchString(a) {
+			return nil, errorAt(lno, "invalid variable name %s", shown(a))
+		}
+		if _, ok := parseGlob(a); c.op != "defined" && !ok {
+			return nil, errInvalidRef(lno, a)
+		}
+	}
+	return c, nil
+}
+
+func (c *cond) String() string {
+	list := make([]string, len(c.args))
+	for i, a := range c.args {
+		list[i] = quote(a)
+	}
+	if c.op == "==" || c.op == "!=" {
+		return fmt.Sprintf("%s %s %s", list[0], c.op, list[1])
+	}
+	s := c.op + " " + strings.Join(list, " ")
+	if c.not {
+		s = "not " + s
+	}
+	return s
+}
+
+func (c *cond) eval(env env) (bool, error) {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		var err error
+		if args[i], err = env.expand(c.lno, a); err != nil {
+			return false, err
+		}
+	}
+	refs := make([]ref, len(args))
+	packs := make([]*pack, len(args))
+	if c.op == "exists" || c.op == "changed" {
+		for i, a := range args {
+			r, ok := parseGlob(a)
+			if !ok {
+				return false, errInvalidRef(c.lno, a)
+			}
+			if packs[i], ok = env.packs[r.pack]; !ok {
+				return false, errUnknownPack(r.pack)
+			}
+			refs[i] = r
+		}
+	}
+
+	var ok bool
+	switch c.op {
+	case "==":
+		ok = args[0] == args[1]
+	case "!=":
+		ok = args[0] != args[1]
+	case "defined":
+		_, ok = env.lookup(args[0])
+	case "exists":
+		if file.HasMeta(refs[0].path) {
+			for range file.Glob(packs[0].tree, refs[0].path) {
+				ok = true
+				break
+			}
+			break
+		}
+		kind, err := packs[0].tree.Stat(refs[0].path)
+		if err != nil {
+			return false, err
+		}
+		ok = kind != file.Absent
+	case "changed":
+		list, err := file.DiffDir(packs[0].tree, refs[0].path, packs[1].tree, refs[1].path)
+		if err != nil {
+			return false, err
+		}
+		ok = len(list) != 0
+	}
+	return ok != c.not, nil
+}
+
+type ifElse struct {
+	cond *cond
+	then []Command
+	els  []Command
+}
+
+func (c *ifElse) String() string {
+	return fmt.Sprintf("if %s", c.cond)
+}
+
+func (c *ifElse) blocks() [][]Command {
+	return [][]Command{c.then, c.els}
+}
+
+func (c *ifElse) run(env env) error {
+	ok, err := c.cond.eval(env)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return env.exec(c.then)
+	}
+	return env.exec(c.els)
+}
+
+// parseEnd checks the end of a block started at line lno.
+func parseEnd(lno int, cmd string, lines []stmt) ([]stmt, error) {
+	if len(lines) == 0 || lines[0].elem[0] != "end" {
+		return nil, errMissingEnd(lno, cmd)
+	}
+	if len(lines[0].elem) != 1 {
+		return nil, errIllegalArgCount(lines[0].no, "end")
+	}
+	return lines[1:], nil
+}
+
+// foreach runs its body with the variable set to every item in turn. A single
+// item naming a tree, as A:path or A:pattern, stands for the files and
+// directories it matches, relative to the literal part of the pattern. A
+// path without a pattern stands for the directory's children.
+type foreach struct {
+	lno   int
+	name  string
+	items []string
+	body  []Command
+}
+
+func (p *parser) parseForeach(lines []stmt) (Command, []stmt, error) {
+	l := lines[0]
+	args := l.elem[1:]
+	if len(args) < 3 || args[1] != "in" {
+		return nil, nil, errIllegalArgCount(l.no, "foreach")
+	}
+	if !patPack.MatchString(args[0]) {
+		return nil, nil, errorAt(l.no, "invalid variable name %s", shown(args[0]))
+	}
+	c := &foreach{lno: l.no, name: args[0], items: args[2:]}
+	if len(c.items) == 1 && !strings.Contains(c.items[0], "${") {
+		if r, ok := parseRef(c.items[0]); ok && patPack.MatchString(r.pack) {
+			if _, ok := parseGlob(c.items[0]); !ok {
+				return nil, nil, errInvalidRef(l.no, c.items[0])
+			}
+		}
+	}
+	body, lines, err := p.parseBlock(lines[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if lines, err = parseEnd(l.no, "foreach", lines); err != nil {
+		return nil, nil, err
+	}
+	c.body = body
+	return c, lines, nil
+}
+
+func (c *foreach) String() string {
+	list := make([]string, len(c.items))
+	for i, a := range c.items {
+		list[i] = quote(a)
+	}
+	return fmt.Sprintf("foreach %s in %s", c.name, strings.Join(list, " "))
+}
+
+func (c *foreach) blocks() [][]Command {
+	return [][]Command{c.body}
+}
+
+func (c *foreach) run(env env) error {
+	items := make([]string, len(c.items))
+	for i, a := range c.items {
+		var err error
+		if items[i], err = env.expand(c.lno, a); err != nil {
+			return err
+		}
+	}
+	if len(items) == 1 {
+		if r, ok := parseGlob(items[0]); ok && patPack.MatchString(r.pack) {
+			src, ok := env.packs[r.pack]
+			if !ok {
+				return errUnknownPack(r.pack)
+			}
+			pattern := r.path
+			if !file.HasMeta(pattern) {
+				pattern = file.Join(pattern, "*")
+			}
+			var err error
+			if items, err = file.GlobPaths(src.tree, pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	old, set := env.vars[c.name]
+	defer func() {
+		if set {
+			env.vars[c.name] = old
+		} else {
+			delete(env.vars, c.name)
+		}
+	}()
+	for _, v := range items {
+		env.vars[c.name] = v
+		if err := env.exec(c.body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxDepth limits nested calls.
+const maxDepth = 100
+
+// def is a procedure run by call with its parameters set as variables. The
+// variables and bindings it sets are local to the call, bindings of the
+// caller it modifies are not.
+type def struct {
+	name   string
+	params []string
+	body   []Command
+}
+
+// parseSignature reads the name and the arguments lineParser split.
+func parseSignature(lno int, cmd string, elem []string) (string, []string, error) {
+	if len(elem) == 0 {
+		return "", nil, errorAt(lno, "invalid %s", cmd)
+	}
+	if !patPack.MatchString(elem[0]) {
+		return "", nil, errorAt(lno, "invalid procedure name %s", elem[0])
+	}
+	return elem[0], elem[1:], nil
+}
+
+func (p *parser) parseDef(lines []stmt) (Command, []stmt, error) {
+	l := lines[0]
+	name, params, err := parseSignature(l.no, "def", l.elem[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, a := range params {
+		if !patPack.MatchString(a) || slices.Contains(params[:i], a) {
+			return nil, nil, errorAt(l.no, "invalid parameter %s", a)
+		}
+	}
+	if _, ok := p.defs[name]; ok {
+		return nil, nil, errorAt(l.no, "procedure %s already defined", name)
+	}
+	c := &def{name: name, params: params}
+	p.defs[name] = c
+	if c.body, lines, err = p.parseBlock(lines[1:]); err != nil {
+		return nil, nil, err
+	}
+	lines, err = parseEnd(l.no, "def", lines)
+	return c, lines, err
+}
+
+func (c *def) String() string {
+	return fmt.Sprintf("def %s(%s)", c.name, strings.Join(c.params, ", "))
+}
+
+func (c *def) blocks() [][]Command {
+	return [][]Command{c.body}
+}
+
+func (c *def) run(env env) error {
+	env.defs[c.name] = c
+	return nil
+}
+
+type call struct {
+	name string
+	args []string
+}
+
+func (p *parser) checkCall(lno int, c *call) error {
+	d, ok := p.defs[c.name]
+	if !ok {
+		return errorAt(lno, "undefined procedure %s", c.name)
+	}
+	if len(c.args) != len(d.params) {
+		return errIllegalArgCount(lno, c.name)
+	}
+	return nil
+}
+
+func (c *call) String() string {
+	list := make([]string, len(c.args))
+	for i, a := range c.args {
+		if list[i] = quote(a); strings.ContainsAny(a, ",()") {
+			list[i] = strconv.Quote(a)
+		}
+	}
+	return fmt.Sprintf("call %s(%s)", c.name, strings.Join(list, ", "))
+}
+
+func (c *call) run(env env) error {
+	d, ok := env.defs[c.name]
+	if !ok {
+		return fmt.Errorf("undefined procedure %s", c.name)
+	}
+	if len(c.args) != len(d.params) {
+		return fmt.Errorf("illegal argument count of procedure %s", c.name)
+	}
+	if env.depth == maxDepth {
+		return fmt.Errorf("calls nested deeper than %d", maxDepth)
+	}
+	local := env
+	local.depth++
+	local.vars = maps.Clone(env.vars)
+	for i, p := range d.params {
+		local.vars[p] = c.args[i]
+	}
+	local.packs = maps.Clone(env.packs)
+	if err := local.exec(d.body); err != nil {
+		return err
+	}
+	for name, p := range local.packs {
+		if env.packs[name] != p && p.mod && p.path != "" {
+			if err := env.write(p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -2,14 +2,22 @@ package script
 
 import (
 	"bytes"
+	"cmp"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
 	"os"
 	"packman/file"
 	"packman/file/mem"
 	"packman/file/vpk"
+	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"text/scanner"
@@ -22,11 +30,48 @@ var (
 )
 
 var (
-	patPack = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	patPack  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	patGroup = regexp.MustCompile(`\$\$|\$[0-9]+[a-zA-Z_]`) // $$ or a group number run into a name
 )
 
+// Error is an error at a line of a script. File names the included script
+// the line belongs to and is empty for the script itself.
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%v at line %d of %s", e.Err, e.Line, e.File)
+	}
+	return fmt.Sprintf("%v at line %d", e.Err, e.Line)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ValidName tells if name can be used for a binding, variable or parameter.
+func ValidName(name string) bool {
+	return patPack.MatchString(name)
+}
+
+func errorAt(lno int, format string, a ...any) error {
+	return &Error{Line: lno, Err: fmt.Errorf(format, a...)}
+}
+
+// shown returns the name for an error message, quoted if empty.
+func shown(name string) string {
+	if name == "" {
+		return `""`
+	}
+	return name
+}
+
 func errInvalidPack(lno int, p string) error {
-	return fmt.Errorf("invalid binding name %s at line %d", p, lno)
+	return errorAt(lno, "invalid binding name %s", shown(p))
 }
 
 func errUnknownPack(p string) error {
@@ -34,19 +79,33 @@ func errUnknownPack(p string) error {
 }
 
 func errIllegalArgCount(lno int, cmd string) error {
-	return fmt.Errorf("illegal argument count of command '%s' at line %d", cmd, lno)
+	return errorAt(lno, "illegal argument count of command '%s'", cmd)
 }
 
 func errInvalidRef(lno int, ref string) error {
-	return fmt.Errorf("invalid reference '%s' at line %d", ref, lno)
+	return errorAt(lno, "invalid reference '%s'", ref)
 }
 
 func errUnknownFlag(lno int, flag string) error {
-	return fmt.Errorf("unknown flag '%s' at line %d", flag, lno)
+	return errorAt(lno, "unknown flag '%s'", flag)
+}
+
+func errReadOnly(p string) error {
+	return fmt.Errorf("binding %s is read-only", p)
+}
+
+func errUnknownCommand(lno int, cmd string) error {
+	return errorAt(lno, "unknown command %s", shown(cmd))
+}
+
+var commands = map[string]bool{
+	"bind": true, "remove": true, "move": true, "sync": true, "copy": true, "clone": true, "set": true, "call": true,
+	"save": true, "unbind": true, "replace": true,
 }
 
 type Script struct {
 	commands []Command
+	pos      map[Command]position
 }
 
 type Command interface {
@@ -55,9 +114,12 @@ type Command interface {
 }
 
 type pack struct {
-	tree file.Tree
-	path string
-	mod  bool
+	tree  file.Tree
+	path  string
+	mod   bool
+	ro    bool
+	depth int       // of the call binding it
+	store io.Closer // a bounded store, closed on unbind
 }
 
 type ref struct {
@@ -79,27 +141,187 @@ func parseRef(r string) (ref, bool) {
 	return ref{r[:i], file.Clean(r[i+1:])}, true
 }
 
+// parseGlob parses a reference that may be a pattern, which keeps its
+// backslashes escaping meta characters.
+func parseGlob(r string) (ref, bool) {
+	p, ok := parseRef(r)
+	if pattern := r[strings.IndexByte(r, ':')+1:]; ok && file.HasMeta(pattern) {
+		if p.path = path.Clean(pattern); file.ValidPattern(p.path) != nil {
+			return ref{}, false
+		}
+	}
+	return p, ok
+}
+
 type env struct {
-	packs map[string]*pack
-	log   func(fmt string, a ...any)
+	packs   map[string]*pack
+	pos     map[Command]position
+	defs    map[string]*def
+	depth   int
+	vars    map[string]string
+	params  map[string]string
+	log     func(fmt string, a ...any)
+	jobs    int
+	budget  int64
+	backup  bool
+	backups map[string]string // the backup of every written path, if any
+	closers *[]io.Closer
+}
+
+// write packs a modified binding to its path, removing an empty VPK.
+func (env env) write(p *pack) error {
+	switch file.Unwrap(p.tree).(type) {
+	case *vpk.Tree, *mem.Store, *mem.BoundedStore:
+	default:
+		return nil
+	}
+	if err := env.writeTree(p.tree, p.path); err != nil {
+		return err
+	}
+	p.mod = false
+	return nil
+}
+
+func (env env) writeTree(tree file.Tree, path string) error {
+	if _, done := env.backups[path]; env.backup && !done {
+		bak, err := file.Backup(path)
+		if err != nil {
+			return err
+		}
+		env.backups[path] = bak
+	}
+	if t, ok := file.Unwrap(tree).(*vpk.Tree); ok && len(*t) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	// a snapshot streams its spilled files instead of packing them in memory
+	src, ok := file.Unwrap(tree).(io.WriterTo)
+	if !ok {
+		data, err := tree.Pack()
+		if err != nil {
+			return err
+		}
+		src = bytes.NewReader(data)
+	}
+	dir, _ := filepath.Split(path)
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0770); err != nil {
+			return err
+		}
+	}
+	return file.WriteFileFrom(path, src, 0660)
+}
+
+// target returns a binding being written to.
+func (env env) target(name string) (*pack, error) {
+	p, ok := env.packs[name]
+	if !ok {
+		return nil, errUnknownPack(name)
+	}
+	if p.ro {
+		return nil, errReadOnly(name)
+	}
+	return p, nil
+}
+
+func (env env) lookup(name string) (string, bool) {
+	if v, ok := env.vars[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// expand replaces every ${name} with the value of the variable, $${ stands
+// for a literal ${.
+func (env env) expand(lno int, s string) (string, error) {
+	var buf strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			buf.WriteString(s[:i])
+			s = s[i+1:]
+			continue
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return "", errorAt(lno, "unterminated variable")
+		}
+		name := s[i+2 : i+j]
+		v, ok := env.lookup(name)
+		if !ok {
+			return "", errorAt(lno, "undefined variable %s", name)
+		}
+		buf.WriteString(s[:i])
+		buf.WriteString(v)
+		s = s[i+j+1:]
+	}
+	buf.WriteString(s)
+	return buf.String(), nil
+}
+
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\"") {
+		return strconv.Quote(s)
+	}
+	return s
 }
 
 type bind struct {
-	name string
+	name   string
+	links  file.Symlinks
+	budget int64
+	ro     bool
 	ref
 }
 
 func (l *bind) String() string {
 	if l.ref == noref {
+		if l.budget != 0 {
+			return fmt.Sprintf("bind -mem=%d %s", l.budget, l.name)
+		}
 		return fmt.Sprintf("bind %s", l.name)
 	}
-	return fmt.Sprintf("bind %s %s", l.name, l.ref)
+	var flags string
+	if l.ro {
+		flags += " -r"
+	}
+	if l.links != file.FollowSymlinks {
+		flags += fmt.Sprintf(" -links=%s", l.links)
+	}
+	return fmt.Sprintf("bind%s %s %s", flags, l.name, l.ref)
+}
+
+func (l *bind) set(env env, tree file.Tree) {
+	// copy and clone read entries in parallel while putting them
+	tree = file.Synchronized(tree)
+	if l.ro {
+		tree = file.ReadOnly(tree)
+	}
+	env.packs[l.name] = &pack{tree: tree, path: l.path, ro: l.ro, depth: env.depth}
 }
 
 func (l *bind) run(env env) error {
+	if p, ok := env.packs[l.name]; ok && p.mod && p.path != "" {
+		if err := env.write(p); err != nil {
+			return err
+		}
+	}
 	if l.ref == noref {
-		s := make(mem.Store)
-		env.packs[l.name] = &pack{tree: &s}
+		p := &pack{depth: env.depth}
+		if budget := cmp.Or(l.budget, env.budget); budget > 0 {
+			s := mem.Bounded(budget)
+			*env.closers = append(*env.closers, s)
+			p.tree, p.store = file.Synchronized(s), s
+		} else {
+			s := make(mem.Store)
+			p.tree = file.Synchronized(&s)
+		}
+		env.packs[l.name] = p
 		return nil
 	}
 	if l.pack == "." {
@@ -112,32 +334,43 @@ func (l *bind) run(env env) error {
 				return err
 			}
 		}
-		ext := filepath.Ext(l.path)
-		isVpk := strings.EqualFold(ext, ".vpk")
-		if !exists && !isVpk || exists && s.IsDir() {
-			loc, err := file.LocalTree(l.path)
+		ext := strings.ToLower(filepath.Ext(l.path))
+		isPack := ext == ".vpk" || ext == ".pms"
+		if !exists && !isPack || exists && s.IsDir() {
+			loc, err := file.LocalTreeLinks(l.path, l.links)
 			if err != nil {
 				return err
 			}
-			env.packs[l.name] = &pack{loc, l.path, false}
+			l.set(env, loc)
 			return nil
 		}
 
-		var tree vpk.Tree
+		var buf []byte
 		if exists {
-			buf, err := os.ReadFile(l.path)
-			if err != nil {
-				if !errors.Is(err, os.ErrNotExist) {
+			if buf, err = os.ReadFile(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		var tree file.Tree
+		if ext == ".pms" {
+			s := make(mem.Store)
+			if len(buf) != 0 {
+				if s, err = mem.Parse(buf); err != nil {
 					return err
 				}
-			} else {
-				if tree, err = vpk.Parse(buf); err != nil {
+			}
+			tree = &s
+		} else {
+			var t vpk.Tree
+			if len(buf) != 0 {
+				if t, err = vpk.Parse(buf); err != nil {
 					return err
 				}
 			}
+			tree = &t
 		}
 
-		env.packs[l.name] = &pack{&tree, l.path, false}
+		l.set(env, tree)
 		return nil
 	} else {
 		_, ok := env.packs[l.pack]
@@ -149,13 +382,23 @@ func (l *bind) run(env env) error {
 }
 
 type cpy struct {
-	src []ref
-	dst ref
+	src  []ref
+	dst  ref
+	jobs int
+}
+
+func appendJobs(buf []byte, jobs int) []byte {
+	if jobs != 0 {
+		buf = append(buf, " -j "...)
+		buf = strconv.AppendInt(buf, int64(jobs), 10)
+	}
+	return buf
 }
 
 func (c *cpy) String() string {
 	var buf []byte
 	buf = append(buf, "copy"...)
+	buf = appendJobs(buf, c.jobs)
 	for _, s := range c.src {
 		buf = append(buf, ' ')
 		buf = append(buf, s.String()...)
@@ -165,45 +408,62 @@ func (c *cpy) String() string {
 	return string(buf)
 }
 
-func (c *cpy) run(env env) error {
-	dst, ok := env.packs[c.dst.pack]
-	if !ok {
-		return errUnknownPack(c.dst.pack)
-	}
+type transfer struct {
+	path string
+	e    file.Entry
+}
 
-	store := func(path string, data []byte) error {
-		if _, err := dst.tree.Store(path, data); err != nil {
-			return err
+func (env env) transfer(dst *pack, list []transfer, jobs int, ln func(path string)) error {
+	if jobs == 0 {
+		jobs = env.jobs
+	}
+	entries := func(yield func(string, file.Entry) bool) {
+		for _, t := range list {
+			if !yield(t.path, t.e) {
+				return
+			}
 		}
+	}
+	if len(list) != 0 {
 		dst.mod = true
-		return nil
 	}
+	return file.Copy(dst.tree, entries, jobs, ln)
+}
 
-	first := len(c.src) == 1
+func (c *cpy) run(env env) error {
+	dst, err := env.target(c.dst.pack)
+	if err != nil {
+		return err
+	}
+
+	var list []transfer
 	for _, s := range c.src {
 		src, ok := env.packs[s.pack]
 		if !ok {
 			return errUnknownPack(s.pack)
 		}
-		for f, e := range src.tree.Find(s.path) {
-			buf, err := e.GetData()
+		kind, err := src.tree.Stat(s.path)
+		if err != nil {
+			return err
+		}
+		if kind == file.Regular {
+			e, err := src.tree.Get(s.path)
 			if err != nil {
 				return err
 			}
-			if first {
-				first = false
-				if e.GetPath() == s.path {
-					if p := c.dst.path; p != "" && p[len(p)-1] != '/' {
-						return store(p, buf)
-					}
-				}
-			}
-			if err = store(file.Join(c.dst.path, f), buf); err != nil {
-				return err
+			p := c.dst.path
+			if len(c.src) != 1 || p == "" {
+				_, name := file.Split(s.path)
+				p = file.Join(p, name)
 			}
+			list = append(list, transfer{p, e})
+			continue
+		}
+		for f, e := range file.Sorted(file.Glob(src.tree, s.path)) {
+			list = append(list, transfer{file.Join(c.dst.path, f), e})
 		}
 	}
-	return nil
+	return env.transfer(dst, list, c.jobs, nil)
 }
 
 const (
@@ -215,6 +475,7 @@ type clone struct {
 	src   []ref
 	dst   string
 	flags int
+	jobs  int
 }
 
 func (c *clone) String() string {
@@ -223,6 +484,10 @@ func (c *clone) String() string {
 	if c.flags&fRegex != 0 {
 		buf = append(buf, " -e"...)
 	}
+	if c.flags&fVerbose != 0 {
+		buf = append(buf, " -v"...)
+	}
+	buf = appendJobs(buf, c.jobs)
 	for _, s := range c.src {
 		buf = append(buf, ' ')
 		buf = append(buf, s.String()...)
@@ -234,11 +499,11 @@ func (c *clone) String() string {
 }
 
 func (c *clone) run(env env) error {
-	dst, ok := env.packs[c.dst]
-	if !ok {
-		return errUnknownPack(c.dst)
+	dst, err := env.target(c.dst)
+	if err != nil {
+		return err
 	}
-	v := c.flags&fVerbose != 0
+	var list []transfer
 	for _, s := range c.src {
 		src, ok := env.packs[s.pack]
 		if !ok {
@@ -249,32 +514,24 @@ func (c *clone) run(env env) error {
 			if err != nil {
 				return err
 			}
-			for _, e := range src.tree.Find(".") {
-				p := e.GetPath()
-				if r.FindString(p) == "" {
-					continue
-				}
-				if _, err := dst.tree.Put(e); err != nil {
-					return err
+			for _, e := range file.FindSorted(src.tree, ".") {
+				if p := e.GetPath(); r.FindString(p) != "" {
+					list = append(list, transfer{p, e})
 				}
-				if v {
-					env.log("| %s", p)
-				}
-				dst.mod = true
 			}
 		} else {
-			for _, e := range src.tree.Find(s.path) {
-				if _, err := dst.tree.Put(e); err != nil {
-					return err
-				}
-				if v {
-					env.log("| %s", e.GetPath())
-				}
-				dst.mod = true
+			for _, e := range file.Sorted(file.Glob(src.tree, s.path)) {
+				list = append(list, transfer{e.GetPath(), e})
 			}
 		}
 	}
-	return nil
+	var ln func(string)
+	if c.flags&fVerbose != 0 {
+		ln = func(path string) {
+			env.log("| %s", path)
+		}
+	}
+	return env.transfer(dst, list, c.jobs, ln)
 }
 
 type remove ref
@@ -284,24 +541,355 @@ func (e *remove) String() string {
 }
 
 func (e *remove) run(env env) error {
-	dst, ok := env.packs[e.pack]
-	if !ok {
-		return errUnknownPack(e.pack)
+	dst, err := env.target(e.pack)
+	if err != nil {
+		return err
 	}
 	dst.mod = true
-	return dst.tree.Remove(e.path, nil)
+	if !file.HasMeta(e.path) {
+		return dst.tree.Remove(e.path, nil)
+	}
+	var paths []string
+	for _, f := range file.Glob(dst.tree, e.path) {
+		paths = append(paths, f.GetPath())
+	}
+	for _, p := range paths {
+		if err := dst.tree.Remove(p, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type move struct {
+	src ref
+	dst ref
+}
+
+func (m *move) String() string {
+	return fmt.Sprintf("move %s %s", m.src, m.dst)
+}
+
+func (m *move) run(env env) error {
+	src, err := env.target(m.src.pack)
+	if err != nil {
+		return err
+	}
+	dst, err := env.target(m.dst.pack)
+	if err != nil {
+		return err
+	}
+	if file.HasMeta(m.src.path) {
+		type match struct {
+			path string
+			e    file.Entry
+		}
+		var matches []match
+		for p, e := range file.Sorted(file.Glob(src.tree, m.src.path)) {
+			matches = append(matches, match{file.Join(m.dst.path, p), e})
+		}
+		for _, f := range matches {
+			if src == dst {
+				if err := src.tree.Rename(f.e.GetPath(), f.path); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := f.e.GetData()
+			if err != nil {
+				return err
+			}
+			if _, err := dst.tree.Store(f.path, data); err != nil {
+				return err
+			}
+			if err := src.tree.Remove(f.e.GetPath(), nil); err != nil {
+				return err
+			}
+		}
+		src.mod, dst.mod = true, true
+		return nil
+	}
+	if src == dst {
+		if err := src.tree.Rename(m.src.path, m.dst.path); err != nil {
+			return err
+		}
+		src.mod = true
+		return nil
+	}
+	c := cpy{[]ref{m.src}, m.dst, 0}
+	if err := c.run(env); err != nil {
+		return err
+	}
+	src.mod = true
+	return src.tree.Remove(m.src.path, nil)
+}
+
+type mirror struct {
+	src     ref
+	dst     ref
+	exclude []string
+	dry     bool
+	jobs    int
+}
+
+func (m *mirror) String() string {
+	var buf []byte
+	buf = append(buf, "sync"...)
+	if m.dry {
+		buf = append(buf, " -n"...)
+	}
+	for _, x := range m.exclude {
+		buf = append(buf, " -x "...)
+		buf = append(buf, x...)
+	}
+	buf = appendJobs(buf, m.jobs)
+	return fmt.Sprintf("%s %s %s", buf, m.src, m.dst)
+}
+
+func (m *mirror) run(env env) error {
+	src, ok := env.packs[m.src.pack]
+	if !ok {
+		return errUnknownPack(m.src.pack)
+	}
+	dst, ok := env.packs[m.dst.pack]
+	if !ok {
+		return errUnknownPack(m.dst.pack)
+	}
+	if dst.ro && !m.dry {
+		return errReadOnly(m.dst.pack)
+	}
+	jobs := m.jobs
+	if jobs == 0 {
+		jobs = env.jobs
+	}
+	list, err := file.Mirror(dst.tree, m.dst.path, src.tree, m.src.path, file.MirrorOptions{
+		Exclude: m.exclude,
+		DryRun:  m.dry,
+		Jobs:    jobs,
+	})
+	if err != nil {
+		return err
+	}
+	for _, d := range list {
+		env.log("| %-8s %s", d.Change, d.Path)
+	}
+	if len(list) != 0 && !m.dry {
+		dst.mod = true
+	}
+	return nil
+}
+
+type set struct {
+	name  string
+	value string
+}
+
+func (c *set) String() string {
+	return fmt.Sprintf("set %s %s", c.name, quote(c.value))
+}
+
+func (c *set) run(env env) error {
+	if _, ok := env.params[c.name]; ok {
+		return nil
+	}
+	env.vars[c.name] = c.value
+	return nil
+}
+
+// replace rewrites the data of files, keeping their mode and time. The
+// pattern is a regular expression with -e and the replacement may then refer
+// to its groups as $1, or as $${1} followed by a letter, since ${1} would be
+// taken for a variable.
+type replace struct {
+	target  ref
+	pattern string
+	repl    string
+	re      *regexp.Regexp
+}
+
+func (c *replace) String() string {
+	flags := ""
+	if c.re != nil {
+		flags = " -e"
+	}
+	return fmt.Sprintf("replace%s %s %s %s", flags, c.target, quote(c.pattern), quote(c.repl))
+}
+
+func (c *replace) run(env env) error {
+	dst, err := env.target(c.target.pack)
+	if err != nil {
+		return err
+	}
+	var list []file.Entry
+	for _, e := range file.Sorted(file.Glob(dst.tree, c.target.path)) {
+		list = append(list, e)
+	}
+	files, matches := 0, 0
+	for _, e := range list {
+		data, err := e.GetData()
+		if err != nil {
+			return err
+		}
+		var n int
+		if c.re != nil {
+			if n = len(c.re.FindAllIndex(data, -1)); n != 0 {
+				data = c.re.ReplaceAll(data, []byte(c.repl))
+			}
+		} else if n = bytes.Count(data, []byte(c.pattern)); n != 0 {
+			data = bytes.ReplaceAll(data, []byte(c.pattern), []byte(c.repl))
+		}
+		if n == 0 {
+			continue
+		}
+		l := &file.Loaded{Entry: e, Path: e.GetPath(), Data: data, CRC: crc32.ChecksumIEEE(data)}
+		if _, err := dst.tree.Put(l); err != nil {
+			return err
+		}
+		dst.mod = true
+		files, matches = files+1, matches+n
+		env.log("| %s (%d)", e.GetPath(), n)
+	}
+	env.log("| %d matches in %d files", matches, files)
+	return nil
+}
+
+// save writes a binding right away, to its own path or to a .vpk or .pms
+// file converting it as needed. The binding is not written at the end unless
+// modified again.
+type save struct {
+	name string
+	path string
+}
+
+func (c *save) String() string {
+	if c.path == "" {
+		return fmt.Sprintf("save %s", c.name)
+	}
+	return fmt.Sprintf("save %s .:%s", c.name, c.path)
+}
+
+func (c *save) run(env env) error {
+	p, ok := env.packs[c.name]
+	if !ok {
+		return errUnknownPack(c.name)
+	}
+	if c.path == "" {
+		if p.ro {
+			return errReadOnly(c.name)
+		}
+		if p.path == "" {
+			return fmt.Errorf("binding %s has no path", c.name)
+		}
+		if err := env.write(p); err != nil {
+			return err
+		}
+		p.mod = false
+		return nil
+	}
+	tree := p.tree
+	switch strings.ToLower(filepath.Ext(c.path)) {
+	case ".vpk":
+		if _, ok := file.Unwrap(tree).(*vpk.Tree); !ok {
+			tree = &vpk.Tree{}
+		}
+	default:
+		switch file.Unwrap(tree).(type) {
+		case *mem.Store, *mem.BoundedStore:
+		default:
+			tree = &mem.Store{}
+		}
+	}
+	if tree != p.tree {
+		if err := file.Copy(tree, p.tree.Find(""), env.jobs, nil); err != nil {
+			return err
+		}
+	}
+	if err := env.writeTree(tree, c.path); err != nil {
+		return err
+	}
+	p.mod = false
+	return nil
+}
+
+// unbind forgets a binding, writing it first if modified. A bounded store is
+// closed unless bound by an enclosing call, which still refers to it.
+type unbind struct {
+	name string
+}
+
+func (c *unbind) String() string {
+	return fmt.Sprintf("unbind %s", c.name)
+}
+
+func (c *unbind) run(env env) error {
+	p, ok := env.packs[c.name]
+	if !ok {
+		return errUnknownPack(c.name)
+	}
+	if p.mod && p.path != "" {
+		if err := env.write(p); err != nil {
+			return err
+		}
+	}
+	delete(env.packs, c.name)
+	if p.store != nil && p.depth == env.depth {
+		*env.closers = slices.DeleteFunc(*env.closers, func(c io.Closer) bool {
+			return c == p.store
+		})
+		return p.store.Close()
+	}
+	return nil
+}
+
+// expand is a command with variables in its arguments, it is parsed once
+// they are substituted.
+type expand struct {
+	lno  int
+	elem []string
+}
+
+func (c *expand) String() string {
+	list := make([]string, len(c.elem))
+	for i, e := range c.elem {
+		list[i] = quote(e)
+	}
+	return strings.Join(list, " ")
+}
+
+func (c *expand) run(env env) error {
+	cmd, err := c.resolve(env)
+	if err != nil {
+		return err
+	}
+	return cmd.run(env)
+}
+
+// resolve substitutes the variables and parses the command.
+func (c *expand) resolve(env env) (Command, error) {
+	elem := make([]string, len(c.elem))
+	for i, e := range c.elem {
+		var err error
+		if elem[i], err = env.expand(c.lno, e); err != nil {
+			return nil, err
+		}
+		if elem[i] == "" && e != "" {
+			return nil, errorAt(c.lno, "%s expands to an empty argument", e)
+		}
+	}
+	return parseCommand(c.lno, elem[0], elem[1:])
 }
 
 type lineParser struct {
 	scanner.Scanner
-	buf []byte
+	buf    []byte
+	quoted bool // the element holds a quoted string, maybe empty
 }
 
 func (s *lineParser) parse(no int, line string) (elem []string, err error) {
 	s.Init(strings.NewReader(line))
 	s.Whitespace = 0
 	s.Mode = scanner.ScanIdents | scanner.ScanStrings
-	s.buf = s.buf[:0]
+	s.buf, s.quoted = s.buf[:0], false
 	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
 		switch tok {
 		case scanner.Ident:
@@ -311,158 +899,610 @@ func (s *lineParser) parse(no int, line string) (elem []string, err error) {
 			if err != nil {
 				return nil, fmt.Errorf("sytaxt error at %d:%d", no, s.Column)
 			}
-			s.buf = append(s.buf, t...)
+			s.buf, s.quoted = append(s.buf, t...), true
 		case ' ', '\t':
-			if len(s.buf) != 0 {
+			if len(s.buf) != 0 || s.quoted {
 				elem = append(elem, string(s.buf))
-				s.buf = s.buf[:0]
+				s.buf, s.quoted = s.buf[:0], false
 			}
 		default:
 			s.buf = utf8.AppendRune(s.buf, tok)
 		}
 	}
-	if len(s.buf) != 0 {
+	if len(s.buf) != 0 || s.quoted {
 		elem = append(elem, string(s.buf))
 	}
+	if len(elem) != 0 && (elem[0] == "def" || elem[0] == "call") {
+		_, rest, _ := strings.Cut(line, elem[0])
+		return s.signature(no, elem[0], rest)
+	}
 	return
 }
 
-func Parse(src []byte) (s Script, err error) {
-	if !utf8.Valid(src) {
-		return s, ErrNonScript
+// signature splits name(a, b) into the name and the arguments. Only unquoted
+// commas and parentheses delimit them, inner pairs of parentheses are kept.
+func (s *lineParser) signature(no int, cmd, sig string) ([]string, error) {
+	invalid := errorAt(no, "invalid %s %s", cmd, strings.TrimSpace(sig))
+	s.Init(strings.NewReader(sig))
+	s.Whitespace = 0
+	s.Mode = scanner.ScanIdents | scanner.ScanStrings
+	s.buf, s.quoted = s.buf[:0], false
+	elem := []string{cmd}
+	next := func() {
+		elem = append(elem, string(s.buf))
+		s.buf, s.quoted = s.buf[:0], false
 	}
-	var lp lineParser
-	lno := 0
-	for len(src) != 0 {
-		lno++
-		var line string
-		i := bytes.IndexByte(src, '\n')
-		if i < 0 {
-			line, src = string(src), src[len(src):]
-		} else {
-			line, src = string(src[:i]), src[i+1:]
-		}
-		line = strings.Trim(line, " \t\r")
-		if len(line) == 0 || line[0] == '#' {
+	depth, space, comma := 0, false, false // depth -1 after the arguments
+	for tok := s.Scan(); tok != scanner.EOF; tok = s.Scan() {
+		switch {
+		case tok == ' ' || tok == '\t':
+			space = len(s.buf) != 0 || s.quoted
+			continue
+		case depth < 0:
+			return nil, invalid
+		case tok == '(' && depth == 0:
+			if len(s.buf) == 0 && !s.quoted {
+				return nil, invalid
+			}
+			next()
+			depth, space = 1, false
+			continue
+		case tok == ',' && depth == 1:
+			next()
+			space, comma = false, true
+			continue
+		case tok == ')' && depth == 1:
+			if len(s.buf) != 0 || s.quoted || comma {
+				next()
+			}
+			depth = -1
 			continue
+		case tok == '(':
+			depth++
+		case tok == ')' && depth > 1:
+			depth--
 		}
-		elem, err := lp.parse(lno, line)
-		if err != nil {
-			return s, err
+		if space {
+			s.buf, space = append(s.buf, ' '), false
 		}
-		switch cmd, args := elem[0], elem[1:]; cmd {
-		case "bind":
-			c := len(args)
-			if c != 1 && c != 2 {
-				return s, errIllegalArgCount(lno, cmd)
+		switch tok {
+		case scanner.Ident:
+			s.buf = append(s.buf, s.TokenText()...)
+		case scanner.String:
+			t, err := strconv.Unquote(s.TokenText())
+			if err != nil {
+				return nil, fmt.Errorf("sytaxt error at %d:%d", no, s.Column)
 			}
-			if !patPack.MatchString(args[0]) {
-				return s, errInvalidPack(lno, args[0])
+			s.buf, s.quoted = append(s.buf, t...), true
+		default:
+			s.buf = utf8.AppendRune(s.buf, tok)
+		}
+	}
+	if depth >= 0 {
+		return nil, invalid
+	}
+	return elem, nil
+}
+
+func Parse(src []byte) (Script, error) {
+	p := parser{dir: ".", pos: make(map[Command]position), defs: make(map[string]*def)}
+	cmds, err := p.parse(src)
+	s := Script{cmds, p.pos}
+	if err == nil {
+		err = s.checkReadOnly()
+	}
+	return s, err
+}
+
+// ParseFile parses the script at path, resolving includes relative to it.
+func ParseFile(path string) (Script, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return Script{}, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return Script{}, err
+	}
+	p := parser{dir: filepath.Dir(path), stack: []string{abs}, pos: make(map[Command]position), defs: make(map[string]*def)}
+	cmds, err := p.parse(src)
+	s := Script{cmds, p.pos}
+	if err == nil {
+		err = s.checkReadOnly()
+	}
+	return s, err
+}
+
+func parseLine(lno int, elem []string) (Command, error) {
+	for _, e := range elem {
+		if strings.Contains(e, "${") {
+			if !commands[elem[0]] && !strings.Contains(elem[0], "${") {
+				return nil, errUnknownCommand(lno, elem[0])
 			}
-			if c == 1 {
-				s.commands = append(s.commands, &bind{args[0], ref{}})
-			} else {
-				p, ok := parseRef(filepath.Clean(args[1]))
-				if !ok {
-					return s, errInvalidRef(lno, args[1])
+			return &expand{lno, elem}, nil
+		}
+	}
+	return parseCommand(lno, elem[0], elem[1:])
+}
+
+func parseCommand(lno int, cmd string, args []string) (Command, error) {
+	switch cmd {
+	case "bind":
+		links := file.FollowSymlinks
+		var budget int64
+		ro := false
+		for len(args) != 0 && strings.HasPrefix(args[0], "-") {
+			if args[0] == "-r" {
+				ro = true
+			} else if v, ok := strings.CutPrefix(args[0], "-links="); ok {
+				if links, ok = file.ParseSymlinks(v); !ok {
+					return nil, errUnknownFlag(lno, args[0])
 				}
-				s.commands = append(s.commands, &bind{args[0], p})
-			}
-		case "remove":
-			if len(args) != 1 {
-				return s, errIllegalArgCount(lno, cmd)
+			} else if v, ok := strings.CutPrefix(args[0], "-mem="); ok {
+				if budget, ok = ParseSize(v); !ok || budget == 0 {
+					return nil, errUnknownFlag(lno, args[0])
+				}
+			} else {
+				return nil, errUnknownFlag(lno, args[0])
 			}
-			p, ok := parseRef(filepath.Clean(args[0]))
+			args = args[1:]
+		}
+		c := len(args)
+		if c != 1 && c != 2 || c == 2 && budget != 0 || c == 1 && ro {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		if !patPack.MatchString(args[0]) {
+			return nil, errInvalidPack(lno, args[0])
+		}
+		if c == 1 {
+			return &bind{args[0], links, budget, false, ref{}}, nil
+		} else {
+			p, ok := parseRef(filepath.Clean(args[1]))
 			if !ok {
-				return s, errInvalidRef(lno, args[0])
-			}
-			s.commands = append(s.commands, (*remove)(&p))
-		case "copy", "clone":
-			end := len(args) - 1
-			if end < 1 {
-				return s, errIllegalArgCount(lno, cmd)
-			}
-			flags := 0
-			for end != 0 && args[0][0] == '-' {
-				if cmd != "clone" {
-					return s, errUnknownFlag(lno, args[0])
+				return nil, errInvalidRef(lno, args[1])
+			}
+			return &bind{args[0], links, 0, ro, p}, nil
+		}
+	case "remove":
+		if len(args) != 1 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		p, ok := parseGlob(filepath.Clean(args[0]))
+		if !ok {
+			return nil, errInvalidRef(lno, args[0])
+		}
+		return (*remove)(&p), nil
+	case "move":
+		if len(args) != 2 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		src, ok := parseGlob(args[0])
+		if !ok {
+			return nil, errInvalidRef(lno, args[0])
+		}
+		dst, ok := parseRef(args[1])
+		if !ok {
+			return nil, errInvalidRef(lno, args[1])
+		}
+		return &move{src, dst}, nil
+	case "sync":
+		var m mirror
+		for len(args) > 2 && strings.HasPrefix(args[0], "-") {
+			switch f := args[0]; {
+			case f == "-n":
+				m.dry = true
+			case f == "-x" && len(args) > 3:
+				if file.ValidPattern(args[1]) != nil {
+					return nil, errInvalidRef(lno, args[1])
 				}
-				switch args[0] {
-				case "-e":
-					flags |= fRegex
-				case "-v":
-					flags |= fVerbose
-				default:
-					return s, errUnknownFlag(lno, args[0])
+				m.exclude = append(m.exclude, args[1])
+				args = args[1:]
+			case strings.HasPrefix(f, "-j"):
+				v := f[2:]
+				if v == "" && len(args) > 3 {
+					args = args[1:]
+					v = args[0]
 				}
-				args, end = args[1:], end-1
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					return nil, errUnknownFlag(lno, f)
+				}
+				m.jobs = n
+			default:
+				return nil, errUnknownFlag(lno, f)
 			}
-			if end == 0 {
-				return s, errIllegalArgCount(lno, cmd)
+			args = args[1:]
+		}
+		if len(args) != 2 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		var ok bool
+		if m.src, ok = parseGlob(args[0]); !ok {
+			return nil, errInvalidRef(lno, args[0])
+		}
+		if m.dst, ok = parseRef(args[1]); !ok {
+			return nil, errInvalidRef(lno, args[1])
+		}
+		return &m, nil
+	case "copy", "clone":
+		end := len(args) - 1
+		if end < 1 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		flags, jobs := 0, 0
+		for end != 0 && strings.HasPrefix(args[0], "-") {
+			switch f := args[0]; {
+			case f == "-e" && cmd == "clone":
+				flags |= fRegex
+			case f == "-v" && cmd == "clone":
+				flags |= fVerbose
+			case strings.HasPrefix(f, "-j"):
+				v := f[2:]
+				if v == "" && end > 1 {
+					args, end = args[1:], end-1
+					v = args[0]
+				}
+				n, err := strconv.Atoi(v)
+				if err != nil || n < 1 {
+					return nil, errUnknownFlag(lno, f)
+				}
+				jobs = n
+			default:
+				return nil, errUnknownFlag(lno, f)
+			}
+			args, end = args[1:], end-1
+		}
+		if end == 0 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		dst, ok := parseRef(args[end])
+		if !ok || cmd == "clone" && dst.path != "" && dst.path != "." {
+			return nil, errInvalidRef(lno, args[end])
+		}
+		src := make([]ref, end)
+		for i, e := range args[:end] {
+			r, ok := parseRef(e)
+			if flags&fRegex == 0 && ok {
+				r, ok = parseGlob(e)
+			}
+			if !ok {
+				return nil, errInvalidRef(lno, e)
+			}
+			src[i] = r
+		}
+		var c Command
+		if cmd == "clone" {
+			c = &clone{src, dst.pack, flags, jobs}
+		} else {
+			c = &cpy{src, dst, jobs}
+		}
+		return c, nil
+	case "call":
+		name, args, err := parseSignature(lno, cmd, args)
+		if err != nil {
+			return nil, err
+		}
+		return &call{name, args}, nil
+	case "replace":
+		c := &replace{}
+		regex := false
+		for len(args) > 3 && strings.HasPrefix(args[0], "-") {
+			if args[0] != "-e" {
+				return nil, errUnknownFlag(lno, args[0])
 			}
-			dst, ok := parseRef(args[end])
-			if !ok || cmd == "clone" && dst.path != "" && dst.path != "." {
-				return s, errInvalidRef(lno, args[end])
+			regex, args = true, args[1:]
+		}
+		if len(args) != 3 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		var ok bool
+		if c.target, ok = parseGlob(args[0]); !ok {
+			return nil, errInvalidRef(lno, args[0])
+		}
+		if c.pattern, c.repl = args[1], args[2]; c.pattern == "" {
+			return nil, errorAt(lno, "empty pattern")
+		}
+		if regex {
+			var err error
+			if c.re, err = regexp.Compile(c.pattern); err != nil {
+				return nil, errorAt(lno, "invalid pattern: %v", err)
 			}
-			src := make([]ref, end)
-			for i, e := range args[:end] {
-				r, ok := parseRef(e)
-				if !ok {
-					return s, errInvalidRef(lno, e)
+			for _, g := range patGroup.FindAllString(c.repl, -1) {
+				if g != "$$" {
+					return nil, errorAt(lno, "ambiguous group %s, write $${%s}%s", g, g[1:len(g)-1], g[len(g)-1:])
 				}
-				src[i] = r
 			}
-			var c Command
-			if cmd == "clone" {
-				c = &clone{src, dst.pack, flags}
-			} else {
-				c = &cpy{src, dst}
+		}
+		return c, nil
+	case "save":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		if !patPack.MatchString(args[0]) {
+			return nil, errInvalidPack(lno, args[0])
+		}
+		c := &save{name: args[0]}
+		if len(args) == 2 {
+			r, ok := parseRef(filepath.Clean(args[1]))
+			if !ok || r.pack != "." || r.path == "" {
+				return nil, errInvalidRef(lno, args[1])
 			}
-			s.commands = append(s.commands, c)
-		default:
-			return s, fmt.Errorf("unknown command %s at line %d", cmd, lno)
+			if ext := strings.ToLower(filepath.Ext(r.path)); ext != ".vpk" && ext != ".pms" {
+				return nil, errorAt(lno, "unsupported format of %s", r.path)
+			}
+			c.path = r.path
+		}
+		return c, nil
+	case "unbind":
+		if len(args) != 1 {
+			return nil, errIllegalArgCount(lno, cmd)
 		}
+		if !patPack.MatchString(args[0]) {
+			return nil, errInvalidPack(lno, args[0])
+		}
+		return &unbind{args[0]}, nil
+	case "set":
+		if len(args) != 2 {
+			return nil, errIllegalArgCount(lno, cmd)
+		}
+		if !patPack.MatchString(args[0]) {
+			return nil, errorAt(lno, "invalid variable name %s", shown(args[0]))
+		}
+		return &set{args[0], args[1]}, nil
+	default:
+		return nil, errUnknownCommand(lno, cmd)
 	}
-	return s, nil
 }
 
-func (s Script) Run(log func(string, ...any)) error {
-	if log == nil {
-		log = func(s string, a ...any) {
+// writes returns the bindings a command writes to.
+func writes(c Command) []string {
+	switch c := c.(type) {
+	case *cpy:
+		return []string{c.dst.pack}
+	case *clone:
+		return []string{c.dst}
+	case *move:
+		return []string{c.src.pack, c.dst.pack}
+	case *remove:
+		return []string{c.pack}
+	case *replace:
+		return []string{c.target.pack}
+	case *mirror:
+		if !c.dry {
+			return []string{c.dst.pack}
+		}
+	case *save:
+		if c.path == "" {
+			return []string{c.name}
 		}
 	}
-	env := env{make(map[string]*pack), log}
-	for _, c := range s.commands {
-		log("%s", c)
-		if err := c.run(env); err != nil {
-			return err
+	return nil
+}
+
+// checkReadOnly reports the writes to read-only bindings known at parse time.
+// A binding rebound in a block is unknown after it, procedures are checked
+// at every call with the bindings of the caller.
+func (s Script) checkReadOnly() error {
+	defs := make(map[string]*def)
+	for c := range each(s.commands) {
+		if d, ok := c.(*def); ok {
+			defs[d.name] = d
 		}
 	}
-	for _, p := range env.packs {
-		if p.mod {
-			tree, ok := p.tree.(*vpk.Tree)
-			if !ok {
-				continue
-			}
-			if len(*tree) == 0 {
-				if err := os.Remove(p.path); err != nil {
-					return err
+	var check func(cmds []Command, ro map[string]bool, calls []*def) error
+	check = func(cmds []Command, ro map[string]bool, calls []*def) error {
+		for _, c := range cmds {
+			switch c := c.(type) {
+			case *bind:
+				ro[c.name] = c.ro
+			case *unbind:
+				delete(ro, c.name)
+			case *def:
+			case *call:
+				if d, ok := defs[c.name]; ok && !slices.Contains(calls, d) {
+					if err := check(d.body, maps.Clone(ro), append(calls, d)); err != nil {
+						return err
+					}
+				}
+			case block:
+				for _, b := range c.blocks() {
+					inner := maps.Clone(ro)
+					if err := check(b, inner, calls); err != nil {
+						return err
+					}
+					for name, r := range ro {
+						if inner[name] != r {
+							delete(ro, name)
+						}
+					}
+				}
+			default:
+				for _, name := range writes(c) {
+					if ro[name] {
+						pos := s.pos[c]
+						return &Error{pos.file, pos.line, errReadOnly(name)}
+					}
 				}
 			}
-			data, err := tree.Pack()
-			if err != nil {
-				return err
+		}
+		return nil
+	}
+	return check(s.commands, make(map[string]bool), nil)
+}
+
+// unresolved stands for the variables only known at run time, such as loop
+// variables and procedure parameters, when looking for sources.
+const unresolved = "\x00"
+
+var patVar = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// Sources returns the local directories the script reads from, that is the
+// directory bindings it never writes to. Lines with variables are resolved
+// with the parameters and the values the script sets. It fails if a binding
+// or a written one depends on a variable known only at run time.
+func (s Script) Sources(params map[string]string) ([]string, error) {
+	env := env{vars: maps.Clone(params), params: params}
+	if env.vars == nil {
+		env.vars = make(map[string]string)
+	}
+	for c := range each(s.commands) {
+		if c, ok := c.(*set); ok {
+			if _, ok := env.vars[c.name]; !ok {
+				env.vars[c.name] = c.value
 			}
-			dir, _ := filepath.Split(p.path)
-			if dir != "" {
-				if err := os.MkdirAll(dir, 0770); err != nil {
-					return err
+		}
+	}
+	var cmds []Command
+	for c := range each(s.commands) {
+		x, ok := c.(*expand)
+		if !ok {
+			cmds = append(cmds, c)
+			continue
+		}
+		for _, e := range x.elem {
+			for _, m := range patVar.FindAllStringSubmatch(e, -1) {
+				if _, ok := env.lookup(m[1]); !ok {
+					env.vars[m[1]] = unresolved
 				}
 			}
-			if err := os.WriteFile(p.path, data, 0660); err != nil {
+		}
+		pos := s.pos[c]
+		r, err := x.resolve(env)
+		if err != nil {
+			if e := (*Error)(nil); errors.As(err, &e) {
+				err = e.Err
+			}
+			if strings.Contains(err.Error(), unresolved) {
+				err = errors.New("the command depends on variables known only at run time")
+			}
+			return nil, &Error{pos.file, pos.line, err}
+		}
+		if b, ok := r.(*bind); ok && strings.Contains(b.path, unresolved) {
+			return nil, &Error{pos.file, pos.line, errors.New("the bound path depends on variables known only at run time")}
+		}
+		if slices.ContainsFunc(writes(r), func(name string) bool { return strings.Contains(name, unresolved) }) {
+			return nil, &Error{pos.file, pos.line, errors.New("the written binding depends on variables known only at run time")}
+		}
+		cmds = append(cmds, r)
+	}
+
+	written := make(map[string]bool)
+	for _, c := range cmds {
+		for _, name := range writes(c) {
+			written[name] = true
+		}
+	}
+	var dirs []string
+	for _, c := range cmds {
+		if b, ok := c.(*bind); ok && b.pack == "." && !written[b.name] {
+			if s, err := os.Stat(b.path); err == nil && s.IsDir() {
+				dirs = append(dirs, b.path)
+			}
+		}
+	}
+	return dirs, nil
+}
+
+type Options struct {
+	Log   func(string, ...any)
+	Trees map[string]file.Tree
+	// Backup keeps a .bak copy of every archive being replaced until all of
+	// them are written.
+	Backup bool
+	// Jobs is the default number of workers of copy and clone, NumCPU if 0.
+	Jobs int
+	// MemBudget bounds the memory of every anonymous binding, see
+	// mem.Bounded. 0 means no limit.
+	MemBudget int64
+	// Vars are the parameters of the script. They take precedence over the
+	// variables the script sets and the environment.
+	Vars map[string]string
+}
+
+// ParseSize reads a byte count with an optional K, M or G suffix.
+func ParseSize(s string) (int64, bool) {
+	shift := 0
+	if n := len(s); n != 0 {
+		switch s[n-1] {
+		case 'k', 'K':
+			shift = 10
+		case 'm', 'M':
+			shift = 20
+		case 'g', 'G':
+			shift = 30
+		}
+		if shift != 0 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, false
+	}
+	return n << shift, true
+}
+
+func (s Script) Run(log func(string, ...any)) error {
+	return s.Exec(Options{Log: log})
+}
+
+func (s Script) Exec(opts Options) error {
+	log := opts.Log
+	if log == nil {
+		log = func(s string, a ...any) {
+		}
+	}
+	for name := range opts.Vars {
+		if !ValidName(name) {
+			return fmt.Errorf("invalid parameter name %q", name)
+		}
+	}
+	jobs := opts.Jobs
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+	var closers []io.Closer
+	defer func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}()
+	env := env{
+		packs:   make(map[string]*pack),
+		pos:     s.pos,
+		defs:    make(map[string]*def),
+		vars:    maps.Clone(opts.Vars),
+		params:  opts.Vars,
+		log:     log,
+		jobs:    jobs,
+		budget:  opts.MemBudget,
+		backup:  opts.Backup,
+		backups: make(map[string]string),
+		closers: &closers,
+	}
+	if env.vars == nil {
+		env.vars = make(map[string]string)
+	}
+	for name, tree := range opts.Trees {
+		env.packs[name] = &pack{tree: file.Synchronized(tree)}
+	}
+	if err := env.exec(s.commands); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(env.packs)) {
+		if p := env.packs[name]; p.mod && p.path != "" {
+			if err := env.write(p); err != nil {
 				return err
 			}
 		}
 	}
+	for _, bak := range env.backups {
+		if bak == "" {
+			continue
+		}
+		if err := os.Remove(bak); err != nil {
+			return err
+		}
+	}
 	return nil
 }
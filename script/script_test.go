@@ -3,16 +3,21 @@ package script
 import (
 	_ "embed"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"log"
 	"maps"
 	"os"
 	"packman/file"
+	"packman/file/mem"
 	"packman/file/vpk"
 	"slices"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 //go:embed test/export.pman
@@ -112,6 +117,27 @@ func TestCopyFile(t *testing.T) {
 	require.FileExists(t, "test/tmp/dirX/f1.txt")
 }
 
+func TestMove(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind A
+		bind B .:test/local.vpk
+		bind T .:test/tmp
+		clone B: A:
+		move  A:dir1 A:dirX
+		move  A:dir2/file22.txt T:f22.txt
+		clone A: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+	require.FileExists(t, "test/tmp/dirX/dir11/file111.md")
+	require.FileExists(t, "test/tmp/f22.txt")
+	require.NoDirExists(t, "test/tmp/dir1")
+	require.NoDirExists(t, "test/tmp/dir2")
+}
+
 func TestMem(t *testing.T) {
 	_ = os.RemoveAll("test/tmp")
 	require.NoError(t, os.Mkdir("test/tmp", 0770))
@@ -141,3 +167,807 @@ func TestRegex(t *testing.T) {
 	require.NoError(t, s.Run(log.Printf))
 	//require.FileExists(t, "test/tmp/dir2/file22.txt")
 }
+
+func TestTrees(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind  T .:test/tmp/fs.vpk
+		clone E: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Exec(Options{
+		Log:   log.Printf,
+		Trees: map[string]file.Tree{"E": file.FSTree(fstest.MapFS{"dir/a.txt": {Data: []byte("a")}})},
+	}))
+
+	d, err := vpk.Read("test/tmp/fs.vpk")
+	require.NoError(t, err)
+	e, err := d.Get("dir/a.txt")
+	require.NoError(t, err)
+	data, err := e.GetData()
+	require.NoError(t, err)
+	require.Equal(t, "a", string(data))
+
+	s, err = Parse([]byte(`copy T:dir E:`))
+	require.NoError(t, err)
+	err = s.Exec(Options{
+		Trees: map[string]file.Tree{"T": d, "E": file.FSTree(fstest.MapFS{})},
+	})
+	require.True(t, errors.Is(err, file.ErrReadOnly))
+}
+
+func TestGlob(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind  A
+		bind  B .:test/local.vpk
+		bind  T .:test/tmp
+		clone B:**/*.txt A:
+		remove A:dir1/**/*.txt
+		copy  B:*.{txt,md} T:root
+		move  A:dir?/*.txt T:moved
+		clone A: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+
+	loc, err := file.LocalTree("test/tmp")
+	require.NoError(t, err)
+	files := slices.Collect(maps.Keys(maps.Collect(loc.Find(""))))
+	slices.Sort(files)
+	assert.Equal(t, "file01.txt moved/dir2/file22.txt root/file01.txt root/file02.md", strings.Join(files, " "))
+
+	_, err = Parse([]byte(`remove A:dir[1`))
+	require.Error(t, err)
+
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/src/d", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/src/d/a{b}.txt", []byte("a"), 0660))
+	require.NoError(t, os.WriteFile("test/tmp/src/d/a*.txt", []byte("b"), 0660))
+	require.NoError(t, os.WriteFile("test/tmp/src/d/ab.txt", []byte("c"), 0660))
+	s, err = Parse([]byte(`
+		bind  S .:test/tmp/src
+		bind  T .:test/tmp/dst
+		copy  S:d/a\{b\}.txt T:
+		move  S:d/a\*.txt T:m
+		remove S:d/a\{b\}.txt
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+	require.FileExists(t, "test/tmp/dst/a{b}.txt")
+	require.FileExists(t, "test/tmp/dst/m/a*.txt")
+	require.NoFileExists(t, "test/tmp/dst/ab.txt")
+	require.NoFileExists(t, "test/tmp/src/d/a{b}.txt")
+	require.FileExists(t, "test/tmp/src/d/ab.txt")
+}
+
+func TestSymlinks(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/src/dir", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/src/dir/f1.txt", []byte("f1"), 0660))
+	require.NoError(t, os.Symlink("dir", "test/tmp/src/link"))
+
+	s, err := Parse([]byte(`
+		bind  -links=skip S .:test/tmp/src
+		bind  T .:test/tmp/dst
+		clone S: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+	require.FileExists(t, "test/tmp/dst/dir/f1.txt")
+	require.NoDirExists(t, "test/tmp/dst/link")
+
+	s, err = Parse([]byte(`
+		bind  -links=error S .:test/tmp/src
+		bind  T .:test/tmp/dst
+		clone S: T:
+	`))
+	require.NoError(t, err)
+	require.ErrorIs(t, s.Run(log.Printf), file.ErrSymlink)
+
+	_, err = Parse([]byte(`bind -links=none S .:test/tmp/src`))
+	require.Error(t, err)
+}
+
+func TestBackup(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind  B .:test/local.vpk
+		bind  T .:test/tmp/out.vpk
+		clone B: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Exec(Options{Backup: true}))
+
+	s, err = Parse([]byte(`
+		bind   T .:test/tmp/out.vpk
+		remove T:dir1
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Exec(Options{Backup: true}))
+	require.NoFileExists(t, "test/tmp/out.vpk.bak")
+
+	d, err := vpk.Read("test/tmp/out.vpk")
+	require.NoError(t, err)
+	files := slices.Collect(maps.Keys(maps.Collect(d.Find(""))))
+	slices.Sort(files)
+	require.Equal(t, "dir2/file22.txt file01.txt file02.md", strings.Join(files, " "))
+	entries, err := os.ReadDir("test/tmp")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(entries))
+}
+
+func TestJobs(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind  A .:test/tmp/imp.vpk
+		bind  D .:test/imp
+		clone -j 4 -v D: A:
+		copy  -j1 D:dir1 A:copy
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+
+	d, err := vpk.Read("test/tmp/imp.vpk")
+	require.NoError(t, err)
+	files := slices.Collect(maps.Keys(maps.Collect(d.Find("copy"))))
+	slices.Sort(files)
+	require.Equal(t, "dir11/file111.md dir12/file121.txt file11.txt file12.txt", strings.Join(files, " "))
+
+	for _, src := range []string{`copy -e D: A:`, `clone -j 0 D: A:`, `clone -j D: A:`} {
+		_, err = Parse([]byte(src))
+		require.Error(t, err, src)
+	}
+}
+
+func TestStableOutput(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	var out [][]byte
+	for i := range 5 {
+		path := fmt.Sprintf("test/tmp/out%d.vpk", i)
+		s, err := Parse([]byte(`
+			bind  A
+			bind  B .:test/local.vpk
+			bind  T .:` + path + `
+			clone B: A:
+			copy  A:dir1 A:dir3
+			clone A: T:
+		`))
+		require.NoError(t, err)
+		require.NoError(t, s.Run(nil))
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		out = append(out, data)
+	}
+	for _, data := range out[1:] {
+		require.Equal(t, out[0], data)
+	}
+}
+
+func TestSources(t *testing.T) {
+	s, err := Parse([]byte(`
+		bind  A .:test
+		bind  B .:test/local.vpk
+		bind  C .:../file
+		bind  M
+		clone A: M:
+		clone M: C:
+	`))
+	require.NoError(t, err)
+	dirs, err := s.Sources(nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"test"}, dirs)
+
+	s, err = Parse([]byte(`
+		set   dst C:
+		bind  A .:${src}
+		bind  C .:${out}
+		bind  M
+		foreach f in A:*.pman
+			copy A:${f} M:
+		end
+		clone M: ${dst}
+	`))
+	require.NoError(t, err)
+	dirs, err = s.Sources(map[string]string{"src": "test", "out": "../file"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"test"}, dirs)
+	_, err = s.Sources(map[string]string{"src": "test"})
+	require.EqualError(t, err, "the bound path depends on variables known only at run time at line 4")
+
+	for src, msg := range map[string]string{
+		"bind A .:test\nforeach d in x y\nbind B .:${d}\nend":     "the bound path depends on variables known only at run time at line 3",
+		"bind A .:test\ndef f(b)\nclone A: ${b}:\nend\ncall f(A)": "the written binding depends on variables known only at run time at line 3",
+		"bind A .:test\nforeach p in A:*\n${p} A:\nend":           "the command depends on variables known only at run time at line 3",
+	} {
+		s, err = Parse([]byte(src))
+		require.NoError(t, err, src)
+		_, err = s.Sources(nil)
+		require.EqualError(t, err, msg, src)
+	}
+}
+
+func TestSync(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/keep", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/stale.txt", []byte("x"), 0660))
+	require.NoError(t, os.WriteFile("test/tmp/keep/cfg", []byte("x"), 0660))
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		bind T .:test/tmp
+		sync -n B:dir1 T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(log.Printf))
+	require.FileExists(t, "test/tmp/stale.txt")
+	require.NoFileExists(t, "test/tmp/file11.txt")
+
+	s, err = Parse([]byte(`
+		bind B .:test/local.vpk
+		bind T .:test/tmp
+		sync -x keep/** -j 2 B:dir1 T:
+	`))
+	require.NoError(t, err)
+	require.Equal(t, "sync -x keep/** -j 2 B:dir1 T:.", s.commands[2].String())
+	require.NoError(t, s.Run(log.Printf))
+	require.NoFileExists(t, "test/tmp/stale.txt")
+	require.FileExists(t, "test/tmp/keep/cfg")
+	require.FileExists(t, "test/tmp/file11.txt")
+	require.FileExists(t, "test/tmp/dir11/file111.md")
+
+	_, err = Parse([]byte(`sync -x [ B: T:`))
+	require.Error(t, err)
+}
+
+func TestInvalidPath(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.MkdirAll("test/tmp/src", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/src/a.txt", []byte("a"), 0660))
+	require.NoError(t, os.WriteFile("test/tmp/src/b\".txt", []byte("b"), 0660))
+
+	s, err := Parse([]byte(`
+		bind A .:test/tmp/src
+		bind T .:test/tmp/out.vpk
+		copy A: T:
+	`))
+	require.NoError(t, err)
+	err = s.Run(nil)
+	require.ErrorIs(t, err, os.ErrInvalid)
+	require.ErrorContains(t, err, `invalid path "b\".txt": illegal character '"'`)
+	require.NoFileExists(t, "test/tmp/out.vpk")
+}
+
+func TestSnapshot(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		bind S .:test/tmp/stage.pms
+		clone B: S:
+		remove S:dir2
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+	require.FileExists(t, "test/tmp/stage.pms")
+
+	s, err = Parse([]byte(`
+		bind S .:test/tmp/stage.pms
+		bind T .:test/tmp/out
+		clone S: T:
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+	require.FileExists(t, "test/tmp/out/dir1/dir11/file111.md")
+	require.NoDirExists(t, "test/tmp/out/dir2")
+}
+
+func TestMemBudget(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind -mem=16 A
+		bind  B .:test/local.vpk
+		bind  T .:test/tmp/out.vpk
+		clone B: A:
+		clone A: T:
+	`))
+	require.NoError(t, err)
+	require.Equal(t, "bind -mem=16 A", s.commands[0].String())
+	require.NoError(t, s.Run(nil))
+	exp, err := os.ReadFile("test/local.vpk")
+	require.NoError(t, err)
+	act, err := os.ReadFile("test/tmp/out.vpk")
+	require.NoError(t, err)
+	require.Equal(t, exp, act)
+
+	// unbind removes the spilled data right away
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	s, err = Parse([]byte(`
+		bind -mem=16 A
+		bind B .:test/local.vpk
+		clone B: A:
+		unbind A
+		bind A
+	`))
+	require.NoError(t, err)
+	spilled := map[string]int{}
+	require.NoError(t, s.Run(func(format string, a ...any) {
+		list, _ := os.ReadDir(tmp)
+		spilled[fmt.Sprintf(format, a...)] = len(list)
+	}))
+	require.Equal(t, 1, spilled["unbind A"])
+	require.Equal(t, 0, spilled["bind A"])
+
+	for _, src := range []string{`bind -mem=0 A`, `bind -mem=1X A`, `bind -mem=1K A .:test`} {
+		_, err := Parse([]byte(src))
+		require.Error(t, err, src)
+	}
+	for v, exp := range map[string]int64{"0": 0, "512": 512, "4k": 4 << 10, "16M": 16 << 20, "2G": 2 << 30} {
+		n, ok := ParseSize(v)
+		require.True(t, ok, v)
+		require.Equal(t, exp, n, v)
+	}
+	_, ok := ParseSize("")
+	require.False(t, ok)
+}
+
+func TestVars(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+	t.Setenv("PACKMAN_SRC", "test/local.vpk")
+
+	s, err := Parse([]byte(`
+		set   out test/tmp/default.vpk
+		set   dir dir1
+		bind  B .:${PACKMAN_SRC}
+		bind  T .:${out}
+		copy  B:${dir}/dir11 "T:${dir} copy"
+		clone B:dir2 T:
+	`))
+	require.NoError(t, err)
+	require.Equal(t, `copy B:${dir}/dir11 "T:${dir} copy"`, s.commands[4].String())
+	require.NoError(t, s.Exec(Options{Vars: map[string]string{"out": "test/tmp/param.vpk"}}))
+	require.NoFileExists(t, "test/tmp/default.vpk")
+	tree, err := vpk.Read("test/tmp/param.vpk")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dir1 copy/file111.md", "dir2/file22.txt"}, slices.Sorted(maps.Keys(maps.Collect(tree.Find("")))))
+
+	s, err = Parse([]byte(`
+		set  a 1
+		set  b "${a} and $${a}"
+		bind ${b} .:test
+	`))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "invalid binding name 1 and ${a} at line 4")
+
+	for src, msg := range map[string]string{
+		`bind A .:${none}`:      "undefined variable none at line 1",
+		`bind A .:${none`:       "unterminated variable at line 1",
+		"set e \"\"\nbind ${e}": "${e} expands to an empty argument at line 2",
+	} {
+		s, err := Parse([]byte(src))
+		require.NoError(t, err)
+		require.EqualError(t, s.Run(nil), msg)
+	}
+	_, err = Parse([]byte(`bnid A .:${x}`))
+	require.EqualError(t, err, "unknown command bnid at line 1")
+	_, err = Parse([]byte(`set 1a x`))
+	require.Error(t, err)
+	s, err = Parse([]byte(`set x 1`))
+	require.NoError(t, err)
+	require.EqualError(t, s.Exec(Options{Vars: map[string]string{"": "x"}}), `invalid parameter name ""`)
+	require.EqualError(t, s.Exec(Options{Vars: map[string]string{"a-b": "x"}}), `invalid parameter name "a-b"`)
+	s, err = Parse([]byte("bind A\ncopy ${src} A:x"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Exec(Options{Vars: map[string]string{"src": ""}}), "${src} expands to an empty argument at line 2")
+}
+
+func TestIf(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		bind T .:test/tmp
+		if exists B:dir1/file11.txt
+			copy B:dir1/file11.txt T:exists.txt
+		end
+		if exists B:dlc
+			copy B:dlc T:
+		else
+			copy B:file01.txt T:no-dlc.txt
+		end
+		if exists B:dir*/**/*.md
+			copy B:file01.txt T:glob.txt
+		end
+		if ${platform} == win
+			copy B:file01.txt T:win.txt
+		else if ${platform} == linux
+			copy B:file01.txt T:linux.txt
+		else
+			copy B:file01.txt T:other.txt
+		end
+		if not defined platform
+			copy B:file01.txt T:undefined.txt
+		end
+		if changed B:dir1 T:mirror
+			sync B:dir1 T:mirror
+			if changed B:dir1 T:mirror
+				copy B:file01.txt T:still.txt
+			end
+		end
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Exec(Options{Vars: map[string]string{"platform": "linux"}}))
+	files, err := os.ReadDir("test/tmp")
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	require.Equal(t, []string{"exists.txt", "glob.txt", "linux.txt", "mirror", "no-dlc.txt"}, names)
+	require.FileExists(t, "test/tmp/mirror/dir11/file111.md")
+
+	for src, msg := range map[string]string{
+		"if exists A:x":                  "missing end of if at line 1",
+		"if exists A:x\nelse\nelse\nend": "missing end of if at line 1",
+		"end":                            "end without if at line 1",
+		"if exists A:x\nend\nelse":       "else without if at line 3",
+		"if exists":                      "illegal argument count of command 'if' at line 1",
+		"if exist A:x\nend":              "unknown condition exist at line 1",
+		"if exists x\nend":               "invalid reference 'x' at line 1",
+	} {
+		_, err := Parse([]byte(src))
+		require.EqualError(t, err, msg, src)
+	}
+}
+
+func TestForeach(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		foreach dir in B:dir*
+			bind P .:test/tmp/${dir}.vpk
+			clone B:${dir} P:
+		end
+		foreach sub in B:dir1
+			if exists B:dir1/${sub}/*.md
+				bind M .:test/tmp/md
+				copy B:dir1/${sub} M:${sub}
+			end
+		end
+		bind L .:test/tmp/locales
+		foreach l in en "pt br"
+			copy B:file01.txt "L:${l}.txt"
+		end
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+
+	for name, exp := range map[string]string{
+		"dir1.vpk": "dir1/dir11/file111.md dir1/dir12/file121.txt dir1/file11.txt dir1/file12.txt",
+		"dir2.vpk": "dir2/file22.txt",
+	} {
+		tree, err := vpk.Read("test/tmp/" + name)
+		require.NoError(t, err)
+		require.Equal(t, exp, strings.Join(slices.Sorted(maps.Keys(maps.Collect(tree.Find("")))), " "))
+	}
+	require.FileExists(t, "test/tmp/md/dir11/file111.md")
+	require.NoDirExists(t, "test/tmp/md/dir12")
+	require.FileExists(t, "test/tmp/locales/en.txt")
+	require.FileExists(t, "test/tmp/locales/pt br.txt")
+
+	_, err = Parse([]byte("foreach x in a b"))
+	require.EqualError(t, err, "missing end of foreach at line 1")
+	_, err = Parse([]byte("foreach x a b\nend"))
+	require.EqualError(t, err, "illegal argument count of command 'foreach' at line 1")
+}
+
+func TestCall(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		def pack_dir(dir, out)
+			bind P .:test/tmp/${out}
+			clone B:${dir} P:
+			set last ${dir}
+		end
+		set last none
+		call pack_dir(dir1, dir1.vpk)
+		call pack_dir(dir2, "two.vpk")
+		bind L .:test/tmp/last
+		copy B:file01.txt L:${last}.txt
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+
+	for name, exp := range map[string]string{
+		"dir1.vpk": "dir1/dir11/file111.md dir1/dir12/file121.txt dir1/file11.txt dir1/file12.txt",
+		"two.vpk":  "dir2/file22.txt",
+	} {
+		tree, err := vpk.Read("test/tmp/" + name)
+		require.NoError(t, err)
+		require.Equal(t, exp, strings.Join(slices.Sorted(maps.Keys(maps.Collect(tree.Find("")))), " "))
+	}
+	require.FileExists(t, "test/tmp/last/none.txt")
+
+	s, err = Parse([]byte(`
+		bind B .:test/local.vpk
+		def out(name, n)
+			bind O .:test/tmp/q
+			copy B:file01.txt O:${name}-${n}.txt
+		end
+		call out("a,b", "(1)")
+		call out(f(x, y), " 2 ")
+	`))
+	require.NoError(t, err)
+	require.Equal(t, `call out("a,b", "(1)")`, s.commands[2].String())
+	require.Equal(t, `call out("f(x, y)", " 2 ")`, s.commands[3].String())
+	require.NoError(t, s.Run(nil))
+	require.FileExists(t, "test/tmp/q/a,b-(1).txt")
+	require.FileExists(t, "test/tmp/q/f(x, y)- 2 .txt")
+
+	_, err = Parse([]byte("call f(a)"))
+	require.EqualError(t, err, "undefined procedure f at line 1")
+	_, err = Parse([]byte("def f(a)\nend\ncall f(a, b)"))
+	require.EqualError(t, err, "illegal argument count of command 'f' at line 3")
+	_, err = Parse([]byte("def f(a, a)\nend"))
+	require.EqualError(t, err, "invalid parameter a at line 1")
+	_, err = Parse([]byte("def f\nend"))
+	require.EqualError(t, err, "invalid def f at line 1")
+	_, err = Parse([]byte("def f(a)\nend\ncall f(a))"))
+	require.EqualError(t, err, "invalid call f(a)) at line 3")
+	_, err = Parse([]byte("def f(a\nend"))
+	require.EqualError(t, err, "invalid def f(a at line 1")
+
+	s, err = Parse([]byte("def f()\ncall f()\nend\ncall f()"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "calls nested deeper than 100 at line 2")
+}
+
+func TestSave(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+	orig, err := os.ReadFile("test/local.vpk")
+	require.NoError(t, err)
+
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		remove B:dir1
+		save B .:test/tmp/patched.vpk
+		save B .:test/tmp/patched.pms
+		bind L .:test/imp
+		save L .:test/tmp/local.vpk
+		unbind L
+		bind M
+		copy B:file01.txt M:file01.txt
+		save M .:test/tmp/out/m.vpk
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+
+	data, err := os.ReadFile("test/local.vpk")
+	require.NoError(t, err)
+	require.Equal(t, orig, data)
+	patched, err := vpk.Read("test/tmp/patched.vpk")
+	require.NoError(t, err)
+	require.Equal(t, "dir2/file22.txt file01.txt file02.md", strings.Join(slices.Sorted(maps.Keys(maps.Collect(patched.Find("")))), " "))
+	store, err := mem.Read("test/tmp/patched.pms")
+	require.NoError(t, err)
+	require.Equal(t, "dir2/file22.txt file01.txt file02.md", strings.Join(slices.Sorted(maps.Keys(maps.Collect(store.Find("")))), " "))
+	local, err := vpk.Read("test/tmp/local.vpk")
+	require.NoError(t, err)
+	require.Len(t, maps.Collect(local.Find("")), 7)
+	require.FileExists(t, "test/tmp/out/m.vpk")
+
+	s, err = Parse([]byte("bind L .:test/imp\nunbind L\ncopy L:file01.txt L:x.txt"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "unknown binding L at line 3")
+	s, err = Parse([]byte("unbind A\nbind A\nunbind A"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "unknown binding A at line 1")
+	_, err = Parse([]byte("bind B\nsave B .:test/tmp/out"))
+	require.EqualError(t, err, "unsupported format of test/tmp/out at line 2")
+	_, err = Parse([]byte("bind B\nsave B X:a.vpk"))
+	require.EqualError(t, err, "invalid reference 'X:a.vpk' at line 2")
+	s, err = Parse([]byte("bind B\nsave B"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "binding B has no path at line 2")
+}
+
+func TestReadOnly(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+	orig, err := os.ReadFile("test/local.vpk")
+	require.NoError(t, err)
+
+	for _, src := range []string{
+		"bind -r G .:test/local.vpk\nbind T .:test/tmp\nclone T: G:",
+		"bind -r G .:test/local.vpk\nbind T .:test/tmp\ncopy T:a G:b",
+		"bind -r G .:test/local.vpk\nbind T .:test/tmp\nmove G:file01.txt T:a",
+		"bind -r G .:test/local.vpk\nbind T .:test/tmp\nsync T: G:",
+		"bind -r G .:test/local.vpk\nif defined x\nbind T\nend\nremove G:dir1",
+		"bind -r G .:test/local.vpk\nsave G",
+	} {
+		_, err := Parse([]byte(src))
+		require.EqualError(t, err, "binding G is read-only at line "+strconv.Itoa(strings.Count(src, "\n")+1), src)
+	}
+	_, err = Parse([]byte("def f()\nremove G:x\nend\nbind G .:test/tmp\ncall f()\nbind -r G .:test/local.vpk\ncall f()"))
+	require.EqualError(t, err, "binding G is read-only at line 2")
+	_, err = Parse([]byte("def f()\nbind G .:test/tmp\nremove G:x\ncall f()\nend\nbind -r G .:test/local.vpk\ncall f()"))
+	require.NoError(t, err)
+
+	s, err := Parse([]byte(`
+		bind -r G .:test/local.vpk
+		bind T .:test/tmp
+		clone G:dir1 T:
+		sync -n G: T:
+		save G .:test/tmp/copy.vpk
+		if defined x
+			bind G .:test/tmp/other.vpk
+		end
+		remove G:file01.txt
+	`))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "binding G is read-only at line 10")
+	require.FileExists(t, "test/tmp/dir1/file11.txt")
+	require.FileExists(t, "test/tmp/copy.vpk")
+
+	s, err = Parse([]byte(`
+		bind -r G .:test/local.vpk
+		def strip(b)
+			remove ${b}:dir1
+		end
+		call strip(G)
+	`))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "binding G is read-only at line 4")
+	s, err = Parse([]byte("bind -r G .:test/local.vpk\nremove ${name}:dir1"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Exec(Options{Vars: map[string]string{"name": "G"}}), "binding G is read-only at line 2")
+
+	data, err := os.ReadFile("test/local.vpk")
+	require.NoError(t, err)
+	require.Equal(t, orig, data)
+
+	_, err = Parse([]byte("bind -r G"))
+	require.EqualError(t, err, "illegal argument count of command 'bind' at line 1")
+}
+
+func TestReplace(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	var logged []string
+	s, err := Parse([]byte(`
+		bind B .:test/local.vpk
+		bind T .:test/tmp/out.vpk
+		clone B: T:
+		replace T:**/*.txt file "a.b"
+		replace -e T:dir1 "^file1(\\d)" "f$1-$1"
+		replace T:file02.md missing x
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(func(format string, a ...any) {
+		logged = append(logged, fmt.Sprintf(format, a...))
+	}))
+
+	tree, err := vpk.Read("test/tmp/out.vpk")
+	require.NoError(t, err)
+	for p, exp := range map[string]string{
+		"file01.txt":            "a.b01",
+		"file02.md":             "file02",
+		"dir1/file11.txt":       "a.b11",
+		"dir1/dir11/file111.md": "f1-11",
+	} {
+		e, err := tree.Get(p)
+		require.NoError(t, err)
+		data, err := e.GetData()
+		require.NoError(t, err)
+		require.Equal(t, exp, string(data), p)
+	}
+	require.Contains(t, logged, "| 5 matches in 5 files")
+	require.Contains(t, logged, "| dir1/dir11/file111.md (1)")
+	require.Contains(t, logged, "| 1 matches in 1 files")
+	require.Contains(t, logged, "| 0 matches in 0 files")
+
+	require.NoError(t, os.Mkdir("test/tmp/loc", 0770))
+	require.NoError(t, os.WriteFile("test/tmp/loc/a.txt", []byte("file01 file02"), 0600))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes("test/tmp/loc/a.txt", time.Time{}, mtime))
+	s, err = Parse([]byte(`
+		bind L .:test/tmp/loc
+		replace L:a.txt "01 " ""
+		replace -e L:a.txt "file(\\d+)" "$${1}x"
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+	data, err := os.ReadFile("test/tmp/loc/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "file02x", string(data))
+	fi, err := os.Stat("test/tmp/loc/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	require.True(t, mtime.Equal(fi.ModTime()), fi.ModTime())
+
+	_, err = Parse([]byte("bind B\nreplace -e B:a \"(\" x"))
+	require.EqualError(t, err, "invalid pattern: error parsing regexp: missing closing ): `(` at line 2")
+	_, err = Parse([]byte("bind B\nreplace B:a \"\" x"))
+	require.EqualError(t, err, "empty pattern at line 2")
+	_, err = Parse([]byte("bind B\nreplace -e B:a b $1x$$1x"))
+	require.EqualError(t, err, "ambiguous group $1x, write $${1}x at line 2")
+	s, err = Parse([]byte("bind B\nreplace -e B:a b ${1}"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "undefined variable 1 at line 2")
+	_, err = Parse([]byte("bind B\nreplace -x B:a b c"))
+	require.EqualError(t, err, "unknown flag '-x' at line 2")
+	_, err = Parse([]byte("bind -r B .:test/local.vpk\nreplace B:a b c"))
+	require.EqualError(t, err, "binding B is read-only at line 2")
+}
+
+func TestEmptyArgs(t *testing.T) {
+	for src, msg := range map[string]string{
+		`bind "" A`:              `invalid binding name "" at line 1`,
+		`bind ""`:                `invalid binding name "" at line 1`,
+		`bind A ""`:              "invalid reference '' at line 1",
+		`copy "" A:x`:            "invalid reference '' at line 1",
+		`copy -j "" A:x A:y`:     "unknown flag '-j' at line 1",
+		`sync "" A:x A:y`:        "illegal argument count of command 'sync' at line 1",
+		`replace "" A:x a b`:     "illegal argument count of command 'replace' at line 1",
+		`remove ""`:              "invalid reference '' at line 1",
+		`save "" .:x.vpk`:        `invalid binding name "" at line 1`,
+		`set "" x`:               `invalid variable name "" at line 1`,
+		`"" A:x`:                 `unknown command "" at line 1`,
+		"foreach \"\" in a\nend": `invalid variable name "" at line 1`,
+	} {
+		_, err := Parse([]byte(src))
+		require.EqualError(t, err, msg, src)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	_ = os.RemoveAll("test/tmp")
+	require.NoError(t, os.Mkdir("test/tmp", 0770))
+
+	s, err := Parse([]byte(`
+		bind T .:test/tmp
+		include test/include/build.pman
+	`))
+	require.NoError(t, err)
+	require.NoError(t, s.Run(nil))
+	require.FileExists(t, "test/tmp/dir1/dir11/file111.md")
+
+	_, err = ParseFile("test/include/a.pman")
+	require.EqualError(t, err, "include cycle through test/include/a.pman at line 2 of test/include/b.pman")
+
+	s, err = Parse([]byte("\ninclude test/include/bad.pman"))
+	require.EqualError(t, err, "unknown flag '-x' at line 2 of test/include/bad.pman")
+	var e *Error
+	require.ErrorAs(t, err, &e)
+	require.Equal(t, Error{"test/include/bad.pman", 2, e.Err}, *e)
+
+	s, err = Parse([]byte("\ninclude test/include/runtime.pman"))
+	require.NoError(t, err)
+	require.EqualError(t, s.Run(nil), "unknown binding X at line 3 of test/include/runtime.pman")
+
+	_, err = Parse([]byte("include test/include/none.pman"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}